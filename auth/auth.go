@@ -0,0 +1,73 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package auth provides credential stores that the proxies can use
+// to authenticate their clients.
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+)
+
+// ErrInvalidCredentials is returned by an Authenticator when the
+// username and password provided do not match.
+var ErrInvalidCredentials = errors.New("auth: invalid credentials")
+
+// Authenticator is the interface that wraps the Authenticate function.
+type Authenticator interface {
+	// Authenticate returns nil if password is valid for user,
+	// an error otherwise.
+	Authenticate(user, password string) error
+}
+
+// Static is an Authenticator backed by an in-memory map
+// of usernames to plain text passwords.
+type Static map[string]string
+
+// Authenticate implements the Authenticator interface.
+func (s Static) Authenticate(user, password string) error {
+	p, ok := s[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+type key int
+
+const userKey key = iota
+
+// NewContext returns a context that carries the name of the
+// authenticated user.
+func NewContext(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// UserFromContext extracts the authenticated user from the context.
+func UserFromContext(ctx context.Context) (string, bool) {
+	u, ok := ctx.Value(userKey).(string)
+	return u, ok
+}
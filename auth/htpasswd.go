@@ -0,0 +1,221 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package auth
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Htpasswd is an Authenticator backed by an Apache htpasswd file.
+// Only the MD5 ($apr1$) and SHA1 ({SHA}) hash formats are supported.
+type Htpasswd struct {
+	path string
+
+	mu    sync.RWMutex
+	users map[string]string // user -> hash
+}
+
+// LoadHtpasswd reads the htpasswd file stored at path.
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// ParseHtpasswd reads htpasswd entries from r.
+func ParseHtpasswd(r io.Reader) (*Htpasswd, error) {
+	users, err := parseHtpasswd(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Htpasswd{users: users}, nil
+}
+
+// Reload reads again the file the receiver was loaded from, replacing
+// its entries if no error occours.
+func (h *Htpasswd) Reload() error {
+	if h.path == "" {
+		return errors.New("Reload: htpasswd was not loaded from a file")
+	}
+
+	f, err := os.Open(h.path)
+	if err != nil {
+		return errors.New("Reload: " + err.Error())
+	}
+	defer f.Close()
+
+	users, err := parseHtpasswd(f)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.users = users
+	h.mu.Unlock()
+	return nil
+}
+
+// Authenticate implements the Authenticator interface.
+func (h *Htpasswd) Authenticate(user, password string) error {
+	h.mu.RLock()
+	hash, ok := h.users[user]
+	h.mu.RUnlock()
+
+	if !ok || !matchHash(hash, password) {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+func parseHtpasswd(r io.Reader) (map[string]string, error) {
+	users := make(map[string]string)
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i < 1 {
+			return nil, errors.New("parseHtpasswd: malformed entry at line " + strconv.Itoa(n))
+		}
+		user, hash := line[:i], line[i+1:]
+		if !strings.HasPrefix(hash, "$apr1$") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, errors.New("parseHtpasswd: unsupported hash format for user " + user)
+		}
+		users[user] = hash
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.New("parseHtpasswd: " + err.Error())
+	}
+
+	return users, nil
+}
+
+func matchHash(hash, password string) bool {
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.TrimPrefix(hash, "$apr1$")
+		if i := strings.IndexByte(salt, '$'); i >= 0 {
+			salt = salt[:i]
+		}
+		computed = apr1(password, salt)
+	default:
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(computed)) == 1
+}
+
+const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 computes the Apache variant of the MD5 based crypt algorithm.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw, s := []byte(password), []byte(salt)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write(s)
+	alt.Write(pw)
+	final := alt.Sum(nil)
+
+	d := md5.New()
+	d.Write(pw)
+	d.Write([]byte(magic))
+	d.Write(s)
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			d.Write(final)
+		} else {
+			d.Write(final[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	final = d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		d := md5.New()
+		if i&1 != 0 {
+			d.Write(pw)
+		} else {
+			d.Write(final)
+		}
+		if i%3 != 0 {
+			d.Write(s)
+		}
+		if i%7 != 0 {
+			d.Write(pw)
+		}
+		if i&1 != 0 {
+			d.Write(final)
+		} else {
+			d.Write(pw)
+		}
+		final = d.Sum(nil)
+	}
+
+	buf := make([]byte, 0, 22)
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			buf = append(buf, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	to64(uint32(final[0])<<16|uint32(final[6])<<8|uint32(final[12]), 4)
+	to64(uint32(final[1])<<16|uint32(final[7])<<8|uint32(final[13]), 4)
+	to64(uint32(final[2])<<16|uint32(final[8])<<8|uint32(final[14]), 4)
+	to64(uint32(final[3])<<16|uint32(final[9])<<8|uint32(final[15]), 4)
+	to64(uint32(final[4])<<16|uint32(final[10])<<8|uint32(final[5]), 4)
+	to64(uint32(final[11]), 2)
+
+	return magic + salt + "$" + string(buf)
+}
@@ -0,0 +1,81 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package auth_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/booster-proj/proxy/auth"
+)
+
+func TestHtpasswd(t *testing.T) {
+	// generated with `openssl passwd -apr1 -salt Jkr6o0Gx secret` and
+	// `htpasswd -nbs sha secret`.
+	in := `# comment
+apr:$apr1$Jkr6o0Gx$Ey/pFMvJP0H8DYdJGi4Oo.
+sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+`
+	h, err := auth.ParseHtpasswd(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		user     string
+		password string
+		err      bool
+	}{
+		{user: "apr", password: "secret", err: false},
+		{user: "apr", password: "Secret", err: true},
+		{user: "sha", password: "secret", err: false},
+		{user: "sha", password: "", err: true},
+		{user: "unknown", password: "secret", err: true},
+	}
+
+	for _, test := range tests {
+		err := h.Authenticate(test.user, test.password)
+		if test.err && err == nil {
+			t.Fatalf("%v: expected authentication failure", test.user)
+		}
+		if !test.err && err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.user, err)
+		}
+	}
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	var tests = []string{
+		"nocolon",
+		":$apr1$Jkr6o0Gx$Ey/pFMvJP0H8DYdJGi4Oo.",
+		"bcrypt:$2y$05$SOMEHASH",
+	}
+
+	for _, in := range tests {
+		if _, err := auth.ParseHtpasswd(strings.NewReader(in)); err == nil {
+			t.Fatalf("expected error parsing %q", in)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"time"
+
+	"github.com/booster-proj/proxy/http"
+	"upspin.io/log"
+)
+
+// genCA implements the gen-ca subcommand, which creates the certificate
+// authority used to intercept TLS sessions.
+func genCA(args []string) {
+	fs := flag.NewFlagSet("gen-ca", flag.ExitOnError)
+	name := fs.String("name", "booster proxy CA", "common name of the certificate authority")
+	certFile := fs.String("cert", "ca.pem", "output file of the PEM encoded certificate")
+	keyFile := fs.String("key", "ca-key.pem", "output file of the PEM encoded private key")
+	validity := fs.Duration("validity", 365*24*time.Hour, "validity period of the certificate")
+	fs.Parse(args)
+
+	certPEM, keyPEM, err := http.GenerateCA(*name, *validity)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(*certFile, certPEM, 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(*keyFile, keyPEM, 0600); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Info.Printf("certificate authority written to %v, private key to %v", *certFile, *keyFile)
+}
@@ -0,0 +1,107 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd
+// socket activation, see sd_listen_fds(3).
+const listenFdsStart = 3
+
+// listen returns a listener for addr, which can be either:
+//   - a TCP address, in the "host:port" form
+//   - "unix:/path/to/socket", a unix domain socket
+//   - "systemd:" or "systemd:name", a socket activated by systemd. The
+//     name, if present, is matched against the FileDescriptorName
+//     option of the socket unit. Otherwise the first socket is used.
+func listen(addr string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return listenUnix(strings.TrimPrefix(addr, "unix:"))
+	case strings.HasPrefix(addr, "systemd:"):
+		return listenSystemd(strings.TrimPrefix(addr, "systemd:"))
+	default:
+		return net.Listen("tcp", addr)
+	}
+}
+
+// listenUnix listens on the unix domain socket at path, removing the
+// socket left there by a previous run, if any.
+func listenUnix(path string) (net.Listener, error) {
+	fi, err := os.Lstat(path)
+	switch {
+	case err == nil && fi.Mode()&os.ModeSocket == 0:
+		return nil, errors.New("listen: " + path + " exists and is not a socket")
+	case err == nil:
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, errors.New("listen: " + err.Error())
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// listenSystemd returns the listener for the socket called name passed
+// by systemd. The LISTEN_* variables are removed from the environment,
+// so that they are not inherited by child processes.
+func listenSystemd(name string) (net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("listen: systemd: no sockets passed to this process")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("listen: systemd: no sockets passed to this process")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < n; i++ {
+		if name != "" && (i >= len(names) || names[i] != name) {
+			continue
+		}
+
+		fd := listenFdsStart + i
+		f := os.NewFile(uintptr(fd), "systemd:"+name)
+		ln, err := net.FileListener(f)
+		f.Close() // FileListener works on a copy of fd
+		if err != nil {
+			return nil, errors.New("listen: systemd: fd " + strconv.Itoa(fd) + ": " + err.Error())
+		}
+		return ln, nil
+	}
+
+	return nil, errors.New("listen: systemd: no socket named " + name)
+}
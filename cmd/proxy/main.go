@@ -26,12 +26,20 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 
 	"github.com/booster-proj/proxy"
+	"github.com/booster-proj/proxy/auth"
+	"github.com/booster-proj/proxy/dialer"
+	"github.com/booster-proj/proxy/http"
+	"github.com/booster-proj/proxy/socks5"
+	"github.com/booster-proj/proxy/transmit"
 	"upspin.io/log"
 )
 
@@ -41,11 +49,37 @@ var (
 	BuildTime = "N/A"
 )
 
-var port = flag.Int("port", 1080, "server listening port")
-var rawProto = flag.String("proto", "", "proxy protocol used. Available protocols: http, https, socks5")
+var port = flag.Int("port", 1080, "server listening port, used when listen is not set")
+var listenAddr = flag.String("listen", "", "address the server listens on: host:port, unix:/path/to/socket or systemd: for socket activation (systemd:name selects a named socket)")
+var rawProto = flag.String("proto", "", "proxy protocol used. Available protocols: http, https, socks5, socks4, auto")
 var verbose = flag.Bool("verbose", false, "enable verbose mode")
+var certFile = flag.String("cert", "", "PEM encoded certificate file, required by the https proto. Enables https clients with the auto proto")
+var keyFile = flag.String("key", "", "PEM encoded private key file, required by the https proto")
+var htpasswd = flag.String("htpasswd", "", "if set, clients must authenticate with credentials stored in this htpasswd file. Supported by the http, https and socks5 protos")
+var clientCA = flag.String("client-ca", "", "if set, https clients must present a certificate signed by the CA stored in this PEM file")
+var mitmCA = flag.String("mitm-ca", "", "PEM encoded CA certificate used to intercept TLS sessions of CONNECT tunnels. See the gen-ca subcommand")
+var mitmKey = flag.String("mitm-key", "", "PEM encoded private key of the interception CA")
+var idleTimeout = flag.Duration("idle-timeout", 0, "if set, tunnels are closed after this duration without data being transferred. Defaults to 30s for http(s), 10m for socks")
+var dns = flag.String("dns", "", "if set, host names are resolved, and cached, using this resolver: system, udp://host[:port], tcp://host[:port], tls://host[:port] or an https:// DNS-over-HTTPS endpoint")
+var happyEyeballs = flag.Bool("happy-eyeballs", false, "if set, the IPv6 and IPv4 addresses of the destinations are raced, as described in RFC 8305")
+var prefer = flag.String("prefer", "ipv6", "address family tried first with happy-eyeballs: ipv6 or ipv4")
+var balance = flag.String("balance", "round-robin", "strategy used to choose the source of each connection: round-robin, least-conn, weighted, sticky, or failover to use the sources in order, moving to the next one when a source keeps failing")
+var sources listFlag
+var routes = flag.String("routes", "", "file containing the rules that route each destination through the direct connection, an upstream proxy or block. See dialer.ParseRule")
+var upstreams listFlag
+var rate = flag.String("rate", "", "bandwidth shared by all the tunnels, in the up/down form, in bytes per second. Accepts K, M and G multipliers, e.g. 1M/10M")
+var rateIP = flag.String("rate-ip", "", "bandwidth shared by the tunnels of each client IP, in the same form of rate")
+var rateUser = flag.String("rate-user", "", "bandwidth shared by the tunnels of each authenticated user, in the same form of rate")
+var mitmHosts = flag.String("mitm-hosts", "", "comma separated list of hosts whose TLS sessions are intercepted. Entries starting with a dot match subdomains")
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gen-ca" {
+		genCA(os.Args[2:])
+		return
+	}
+
+	flag.Var(&sources, "source", "network interface or local IP address connections originate from, optionally followed by *weight, e.g. eth0*2. Can be repeated to balance the connections among several sources")
+	flag.Var(&upstreams, "upstream", "upstream proxy usable by the routes, in the name=url form, e.g. corp=http://proxy.example.com:3128. Supports socks5, http and https URLs. Can be repeated")
 	flag.Parse()
 
 	log.Info.Printf("Version: %s, BuildTime: %s\n\n", Version, BuildTime)
@@ -63,12 +97,34 @@ func main() {
 		log.Fatal(err)
 	}
 
+	var cas []string
+	if *clientCA != "" {
+		cas = append(cas, *clientCA)
+	}
+
 	var p proxy.Proxy
 	switch proto {
 	case proxy.HTTP:
 		p, err = proxy.NewHTTP()
+	case proxy.HTTPS:
+		if *certFile == "" || *keyFile == "" {
+			log.Fatal(errors.New("cert and key flags are required by the https proto"))
+		}
+		p, err = proxy.NewHTTPS(*certFile, *keyFile, cas...)
 	case proxy.SOCKS5:
 		p, err = proxy.NewSOCKS5()
+	case proxy.SOCKS4:
+		p, err = proxy.NewSOCKS4()
+	case proxy.Auto:
+		m := proxy.NewMux()
+		if *certFile != "" {
+			var hp proxy.Proxy
+			if hp, err = proxy.NewHTTPS(*certFile, *keyFile, cas...); err != nil {
+				break
+			}
+			m.HTTPS = hp.(*http.Proxy)
+		}
+		p = m
 	default:
 		err = errors.New("protocol (" + *rawProto + ") is not yet supported")
 	}
@@ -76,6 +132,126 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if *htpasswd != "" {
+		a, err := auth.LoadHtpasswd(*htpasswd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		switch p := p.(type) {
+		case *http.Proxy:
+			p.Authenticator = a
+		case *socks5.Proxy:
+			p.Authenticator = a
+		case *proxy.Mux:
+			for _, hp := range []*http.Proxy{p.HTTP, p.HTTPS} {
+				if hp != nil {
+					hp.Authenticator = a
+				}
+			}
+			p.SOCKS5.Authenticator = a
+			// SOCKS4 clients cannot authenticate.
+			p.SOCKS4 = nil
+		default:
+			log.Fatal(errors.New("protocol (" + *rawProto + ") does not support authentication"))
+		}
+	}
+
+	if *mitmCA != "" {
+		ca, err := tls.LoadX509KeyPair(*mitmCA, *mitmKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		i, err := http.NewInterceptor(ca, strings.Split(*mitmHosts, ",")...)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		switch p := p.(type) {
+		case *http.Proxy:
+			p.Interceptor = i
+		case *proxy.Mux:
+			for _, hp := range []*http.Proxy{p.HTTP, p.HTTPS} {
+				if hp != nil {
+					hp.Interceptor = i
+				}
+			}
+		default:
+			log.Fatal(errors.New("protocol (" + *rawProto + ") does not support TLS interception"))
+		}
+	}
+
+	var wrap func(dialer.Dialer) dialer.Dialer
+	var resolver dialer.Resolver
+	if *dns != "" {
+		r, err := dialer.ParseResolver(*dns)
+		if err != nil {
+			log.Fatal(err)
+		}
+		resolver = dialer.NewCache(r)
+		wrap = func(d dialer.Dialer) dialer.Dialer {
+			return dialer.NewResolving(resolver, d)
+		}
+	}
+	if *happyEyeballs {
+		family, err := dialer.ParseFamily(*prefer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if resolver == nil {
+			resolver = dialer.NewCache(dialer.System)
+		}
+		wrap = func(d dialer.Dialer) dialer.Dialer {
+			h := dialer.NewHappyEyeballs(resolver, d)
+			h.Prefer = family
+			return h
+		}
+	}
+
+	var d dialer.Dialer = dialer.Default
+	if len(sources) > 0 {
+		// host names are resolved by each source, the balancer
+		// sees the destinations requested by the clients.
+		if d, err = newBalancer(*balance, sources, wrap); err != nil {
+			log.Fatal(err)
+		}
+	} else if wrap != nil {
+		d = wrap(d)
+	}
+	if *routes != "" {
+		if d, err = newRouter(*routes, upstreams, d); err != nil {
+			log.Fatal(err)
+		}
+	} else if len(upstreams) > 0 {
+		log.Fatal(errors.New("upstream flag requires the routes flag"))
+	}
+	p.DialWith(d)
+
+	rs, err := relays(p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *idleTimeout != 0 {
+		for _, r := range rs {
+			r.IdleTimeout = *idleTimeout
+		}
+	}
+	if *rate != "" || *rateIP != "" || *rateUser != "" {
+		t := new(transmit.Throttle)
+		if t.Rate, err = parseRate(*rate); err != nil {
+			log.Fatal(err)
+		}
+		if t.PerIP, err = parseRate(*rateIP); err != nil {
+			log.Fatal(err)
+		}
+		if t.PerUser, err = parseRate(*rateUser); err != nil {
+			log.Fatal(err)
+		}
+		for _, r := range rs {
+			r.Throttle = t
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -88,8 +264,17 @@ func main() {
 		}
 	}()
 
-	log.Info.Printf("proxy (%v) listening on :%d", p.Protocol(), *port)
-	if err := p.ListenAndServe(ctx, *port); err != nil {
+	addr := *listenAddr
+	if addr == "" {
+		addr = ":" + strconv.Itoa(*port)
+	}
+	ln, err := listen(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Info.Printf("proxy (%v) listening on %v", p.Protocol(), ln.Addr())
+	if err := p.Serve(ctx, ln); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,118 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/booster-proj/proxy"
+	"github.com/booster-proj/proxy/http"
+	"github.com/booster-proj/proxy/socks4"
+	"github.com/booster-proj/proxy/socks5"
+	"github.com/booster-proj/proxy/transmit"
+)
+
+// parseRate parses a rate in the "up/down" form, where both limits are
+// expressed in bytes per second, optionally followed by one of the K, M
+// and G multipliers, e.g. "512K/4M". A zero or missing limit means
+// unlimited, e.g. "1M" limits only the upload.
+func parseRate(s string) (transmit.Rate, error) {
+	var r transmit.Rate
+	if s == "" {
+		return r, nil
+	}
+
+	up, down := s, ""
+	if i := strings.Index(s, "/"); i >= 0 {
+		up, down = s[:i], s[i+1:]
+	}
+
+	var err error
+	if r.Up, err = parseBytes(up); err != nil {
+		return r, errors.New("parseRate: " + err.Error())
+	}
+	if r.Down, err = parseBytes(down); err != nil {
+		return r, errors.New("parseRate: " + err.Error())
+	}
+	return r, nil
+}
+
+func parseBytes(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	m := int64(1)
+	switch s[len(s)-1] {
+	case 'K', 'k':
+		m = 1 << 10
+	case 'M', 'm':
+		m = 1 << 20
+	case 'G', 'g':
+		m = 1 << 30
+	}
+	if m > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("negative rate: " + s)
+	}
+	return n * m, nil
+}
+
+// relays returns the relays used by p to copy the data of its tunnels.
+func relays(p proxy.Proxy) ([]*transmit.Relay, error) {
+	switch p := p.(type) {
+	case *http.Proxy:
+		return []*transmit.Relay{&p.Relay}, nil
+	case *socks5.Proxy:
+		return []*transmit.Relay{&p.Relay}, nil
+	case *socks4.Proxy:
+		return []*transmit.Relay{&p.Relay}, nil
+	case *proxy.Mux:
+		var rs []*transmit.Relay
+		for _, hp := range []*http.Proxy{p.HTTP, p.HTTPS} {
+			if hp != nil {
+				rs = append(rs, &hp.Relay)
+			}
+		}
+		if p.SOCKS5 != nil {
+			rs = append(rs, &p.SOCKS5.Relay)
+		}
+		if p.SOCKS4 != nil {
+			rs = append(rs, &p.SOCKS4.Relay)
+		}
+		return rs, nil
+	default:
+		return nil, errors.New("protocol (" + p.Protocol() + ") does not relay data")
+	}
+}
@@ -0,0 +1,66 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/booster-proj/proxy"
+	"github.com/booster-proj/proxy/dialer"
+)
+
+// newRouter returns a router that uses the rules stored in the file
+// called name, see dialer.ParseRule. Rules can route connections through
+// the "direct" route, which uses d, and through the upstream proxies
+// described by upstreams, in the "name=url" form, which are reached using
+// d too. Connections not matched by any rule use d.
+func newRouter(name string, upstreams []string, d dialer.Dialer) (*dialer.Router, error) {
+	rules, err := dialer.LoadRules(name)
+	if err != nil {
+		return nil, err
+	}
+
+	r := dialer.NewRouter(d, rules...)
+	r.Dialers["direct"] = d
+	for _, s := range upstreams {
+		i := strings.Index(s, "=")
+		if i <= 0 {
+			return nil, errors.New("newRouter: invalid upstream, expected name=url: " + s)
+		}
+		route, rawurl := s[:i], s[i+1:]
+		if _, ok := r.Dialers[route]; ok || route == dialer.Block {
+			return nil, errors.New("newRouter: duplicate upstream: " + route)
+		}
+		if r.Dialers[route], err = proxy.ParseUpstream(rawurl, d); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := r.Check(); err != nil {
+		return nil, errors.New("newRouter: " + name + ": " + err.Error())
+	}
+	return r, nil
+}
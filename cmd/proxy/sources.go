@@ -0,0 +1,107 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/booster-proj/proxy/dialer"
+	"upspin.io/log"
+)
+
+// listFlag is a flag that can be repeated, collecting its values.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// parseSource parses a source of the balancer, in the
+// "interface-or-ip[*weight]" form, e.g. "eth0*2".
+func parseSource(s string) (dialer.Source, error) {
+	src := dialer.Source{Name: s, Weight: 1}
+	if i := strings.LastIndex(s, "*"); i >= 0 {
+		w, err := strconv.Atoi(s[i+1:])
+		if err != nil {
+			return src, errors.New("parseSource: invalid weight: " + err.Error())
+		}
+		s, src.Name, src.Weight = s[:i], s[:i], w
+	}
+
+	if ip := net.ParseIP(s); ip != nil {
+		src.Dialer = &dialer.Local{IP: ip}
+		return src, nil
+	}
+	l, err := dialer.NewInterface(s)
+	if err != nil {
+		return src, errors.New("parseSource: " + err.Error())
+	}
+	src.Dialer = l
+	return src, nil
+}
+
+// newBalancer returns a dialer that uses the sources described by
+// specs, see parseSource. The dialers of the sources are wrapped by wrap,
+// if not nil. With the "failover" strategy, the sources are tried in
+// order, and weights are ignored; otherwise a dialer.Balancer is returned.
+func newBalancer(strategy string, specs []string, wrap func(dialer.Dialer) dialer.Dialer) (dialer.Dialer, error) {
+	sources := make([]dialer.Source, 0, len(specs))
+	for _, spec := range specs {
+		s, err := parseSource(spec)
+		if err != nil {
+			return nil, err
+		}
+		if wrap != nil {
+			s.Dialer = wrap(s.Dialer)
+		}
+		sources = append(sources, s)
+	}
+
+	if strategy == "failover" {
+		paths := make([]dialer.Path, 0, len(sources))
+		for _, s := range sources {
+			paths = append(paths, dialer.Path{Name: s.Name, Dialer: s.Dialer})
+		}
+		f := dialer.NewFailover(paths...)
+		f.OnStateChange = func(path string, from, to dialer.State) {
+			log.Info.Printf("Failover: source %v: %v -> %v", path, from, to)
+		}
+		return f, nil
+	}
+
+	st, err := dialer.ParseStrategy(strategy)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.NewBalancer(st, sources...)
+}
@@ -0,0 +1,342 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dialer
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrNoSources is returned by a Balancer without sources.
+var ErrNoSources = errors.New("dialer: no sources available")
+
+// Local is a Dialer whose connections originate from a local IP address,
+// i.e. from the network interface that owns it. Destinations not
+// reachable from IP's family cannot be dialed.
+type Local struct {
+	IP net.IP
+}
+
+// NewInterface returns a Local dialer bound to the first address of the
+// network interface name, preferring IPv4 addresses.
+func NewInterface(name string) (*Local, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, errors.New("NewInterface: " + err.Error())
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, errors.New("NewInterface: " + err.Error())
+	}
+
+	var ip net.IP
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if n.IP.To4() != nil {
+			return &Local{IP: n.IP}, nil
+		}
+		if ip == nil {
+			ip = n.IP
+		}
+	}
+	if ip == nil {
+		return nil, errors.New("NewInterface: no usable address found on " + name)
+	}
+	return &Local{IP: ip}, nil
+}
+
+// DialContext dials addr from the local address of the receiver.
+func (l *Local) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := new(net.Dialer)
+	switch {
+	case strings.HasPrefix(network, "tcp"):
+		d.LocalAddr = &net.TCPAddr{IP: l.IP}
+	case strings.HasPrefix(network, "udp"):
+		d.LocalAddr = &net.UDPAddr{IP: l.IP}
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// Strategy tells a Balancer how to choose the source of a connection.
+type Strategy uint8
+
+// Strategies available.
+const (
+	// RoundRobin uses the sources in turn.
+	RoundRobin Strategy = iota
+	// LeastConn uses the source with the least active connections.
+	LeastConn
+	// Weighted uses the sources in turn, proportionally to their
+	// weight.
+	Weighted
+	// Sticky always uses the same source for the same destination
+	// host, as long as the source is available.
+	Sticky
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case RoundRobin:
+		return "round-robin"
+	case LeastConn:
+		return "least-conn"
+	case Weighted:
+		return "weighted"
+	case Sticky:
+		return "sticky"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseStrategy returns the Strategy whose string representation is s.
+func ParseStrategy(s string) (Strategy, error) {
+	for _, st := range []Strategy{RoundRobin, LeastConn, Weighted, Sticky} {
+		if st.String() == s {
+			return st, nil
+		}
+	}
+	return 0, errors.New("ParseStrategy: unrecognised strategy: " + s)
+}
+
+// Source is one of the dialers of a Balancer.
+type Source struct {
+	// Name identifies the source.
+	Name   string
+	Dialer Dialer
+	// Weight is used by the Weighted strategy. Values lower than 1
+	// are treated as 1.
+	Weight int
+}
+
+// source stores the state of a Source inside a Balancer.
+type source struct {
+	Source
+	active  int64 // accessed atomically
+	current int   // of the smooth weighted round robin
+}
+
+func (s *source) weight() int {
+	if s.Weight < 1 {
+		return 1
+	}
+	return s.Weight
+}
+
+// Balancer is a Dialer that distributes the connections among its
+// sources, following its strategy. Sources can be added and removed
+// while the balancer is in use.
+type Balancer struct {
+	strategy Strategy
+
+	mu      sync.Mutex
+	sources []*source
+	next    int // of the round robin
+}
+
+// NewBalancer returns a Balancer that chooses among sources following
+// strategy.
+func NewBalancer(strategy Strategy, sources ...Source) (*Balancer, error) {
+	b := &Balancer{strategy: strategy}
+	for _, s := range sources {
+		if err := b.Add(s); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Add adds s to the sources of the receiver. Names must be unique.
+func (b *Balancer) Add(s Source) error {
+	if s.Dialer == nil {
+		return errors.New("Add: source " + s.Name + " has no dialer")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, v := range b.sources {
+		if v.Name == s.Name {
+			return errors.New("Add: source " + s.Name + " already present")
+		}
+	}
+	b.sources = append(b.sources, &source{Source: s})
+	return nil
+}
+
+// Remove removes the source called name from the receiver. The
+// connections already opened through it are not closed. Returns false if
+// no such source is present.
+func (b *Balancer) Remove(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, v := range b.sources {
+		if v.Name == name {
+			b.sources = append(b.sources[:i], b.sources[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Sources returns the sources of the receiver.
+func (b *Balancer) Sources() []Source {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	res := make([]Source, len(b.sources))
+	for i, v := range b.sources {
+		res[i] = v.Source
+	}
+	return res
+}
+
+// DialContext dials addr using the source chosen by the strategy of the
+// receiver.
+func (b *Balancer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	s, err := b.pick(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := s.Dialer.DialContext(ctx, network, addr)
+	if b.strategy != LeastConn {
+		return conn, err
+	}
+
+	// the connection was counted by pick.
+	done := func() { atomic.AddInt64(&s.active, -1) }
+	if err != nil {
+		done()
+		return nil, err
+	}
+	return newTrackedConn(conn, done), nil
+}
+
+func (b *Balancer) pick(addr string) (*source, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.sources) == 0 {
+		return nil, ErrNoSources
+	}
+
+	switch b.strategy {
+	case LeastConn:
+		// the connection is counted before being dialed, so that
+		// concurrent dials see each other.
+		best := b.sources[0]
+		for _, s := range b.sources[1:] {
+			if atomic.LoadInt64(&s.active) < atomic.LoadInt64(&best.active) {
+				best = s
+			}
+		}
+		atomic.AddInt64(&best.active, 1)
+		return best, nil
+	case Weighted:
+		// smooth weighted round robin, which interleaves the
+		// choices instead of picking the same source in bursts.
+		var best *source
+		total := 0
+		for _, s := range b.sources {
+			s.current += s.weight()
+			total += s.weight()
+			if best == nil || s.current > best.current {
+				best = s
+			}
+		}
+		best.current -= total
+		return best, nil
+	case Sticky:
+		// rendezvous hashing: removing a source moves only the
+		// destinations that were using it.
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		var best *source
+		var max uint64
+		for _, s := range b.sources {
+			h := fnv.New64a()
+			h.Write([]byte(s.Name))
+			h.Write([]byte{0})
+			h.Write([]byte(host))
+			if sum := h.Sum64(); best == nil || sum > max {
+				best, max = s, sum
+			}
+		}
+		return best, nil
+	default:
+		b.next %= len(b.sources)
+		s := b.sources[b.next]
+		b.next++
+		return s, nil
+	}
+}
+
+// closeWriter is implemented by the connections that support half-close.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// trackedConn calls onClose the first time it is closed. The wrapped
+// connection is available through Unwrap, e.g. to splice data directly
+// between TCP connections.
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func()
+}
+
+func newTrackedConn(conn net.Conn, onClose func()) net.Conn {
+	return &trackedConn{Conn: conn, onClose: onClose}
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.onClose)
+	return c.Conn.Close()
+}
+
+// Unwrap returns the connection wrapped by c.
+func (c *trackedConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite closes the write side of the connection, if supported.
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("CloseWrite: not supported by " + c.Conn.LocalAddr().Network() + " connections")
+}
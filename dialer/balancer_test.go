@@ -0,0 +1,315 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dialer_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/booster-proj/proxy/dialer"
+)
+
+// recorder provides dialers that record their name when used.
+type recorder struct {
+	sync.Mutex
+	names []string
+}
+
+func (r *recorder) source(name string, weight int) dialer.Source {
+	return dialer.Source{
+		Name:   name,
+		Weight: weight,
+		Dialer: dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			r.Lock()
+			r.names = append(r.names, name)
+			r.Unlock()
+
+			c1, c2 := net.Pipe()
+			c2.Close()
+			return c1, nil
+		}),
+	}
+}
+
+func (r *recorder) last() string {
+	r.Lock()
+	defer r.Unlock()
+	return r.names[len(r.names)-1]
+}
+
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+func dial(t *testing.T, d dialer.Dialer, addr string) net.Conn {
+	conn, err := d.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestBalancerRotation(t *testing.T) {
+	var tests = []struct {
+		strategy dialer.Strategy
+		weights  []int
+		want     string
+	}{
+		{strategy: dialer.RoundRobin, weights: []int{1, 1, 1}, want: "abcabc"},
+		{strategy: dialer.RoundRobin, weights: []int{5, 1, 1}, want: "abcabc"},
+		{strategy: dialer.Weighted, weights: []int{1, 1, 1}, want: "abcabc"},
+		{strategy: dialer.Weighted, weights: []int{4, 2, 0}, want: "abacabaabaca"},
+	}
+
+	for _, test := range tests {
+		r := new(recorder)
+		b, err := dialer.NewBalancer(test.strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, w := range test.weights {
+			b.Add(r.source(string(rune('a'+i)), w))
+		}
+
+		found := ""
+		for range test.want {
+			dial(t, b, "192.0.2.1:80").Close()
+			found += r.last()
+		}
+		if found != test.want {
+			t.Fatalf("%v %v: unexpected sequence: wanted %v, found %v", test.strategy, test.weights, test.want, found)
+		}
+	}
+}
+
+func TestBalancerLeastConn(t *testing.T) {
+	r := new(recorder)
+	b, err := dialer.NewBalancer(dialer.LeastConn, r.source("a", 1), r.source("b", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1 := dial(t, b, "192.0.2.1:80")
+	if r.last() != "a" {
+		t.Fatalf("unexpected source: %v", r.last())
+	}
+	c2 := dial(t, b, "192.0.2.1:80")
+	if r.last() != "b" {
+		t.Fatalf("unexpected source: %v", r.last())
+	}
+	c3 := dial(t, b, "192.0.2.1:80")
+	if r.last() != "a" {
+		t.Fatalf("unexpected source: %v", r.last())
+	}
+
+	// closing twice must not count twice
+	c2.Close()
+	c2.Close()
+	dial(t, b, "192.0.2.1:80")
+	if r.last() != "b" {
+		t.Fatalf("unexpected source: %v", r.last())
+	}
+
+	c1.Close()
+	c3.Close()
+}
+
+func TestBalancerLeastConnConcurrent(t *testing.T) {
+	// the dials complete only when released, all of them are
+	// in progress at the same time.
+	release := make(chan struct{})
+	var mu sync.Mutex
+	count := make(map[string]int)
+	source := func(name string, fail bool) dialer.Source {
+		return dialer.Source{Name: name, Dialer: dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			count[name]++
+			mu.Unlock()
+
+			<-release
+			if fail {
+				return nil, errors.New("dial failed")
+			}
+			c1, c2 := net.Pipe()
+			c2.Close()
+			return c1, nil
+		})}
+	}
+
+	b, err := dialer.NewBalancer(dialer.LeastConn, source("a", false), source("b", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if conn, err := b.DialContext(context.Background(), "tcp", "192.0.2.1:80"); err == nil {
+				defer conn.Close()
+			}
+		}()
+	}
+	for {
+		mu.Lock()
+		n := count["a"] + count["b"]
+		mu.Unlock()
+		if n == 4 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if count["a"] != 2 || count["b"] != 2 {
+		t.Fatalf("unexpected distribution: %v", count)
+	}
+
+	// the failed dials of b are not counted, b is chosen again.
+	b.Remove("a")
+	b.Add(source("c", false))
+	if _, err := b.DialContext(context.Background(), "tcp", "192.0.2.1:80"); err == nil {
+		t.Fatal("expected the dial through b to fail")
+	}
+}
+
+func TestBalancerUnwrap(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	b, err := dialer.NewBalancer(dialer.LeastConn, dialer.Source{Name: "default", Dialer: dialer.Default})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := dial(t, b, ln.Addr().String())
+	defer conn.Close()
+
+	// the TCP connection is reachable, e.g. to splice data.
+	w, ok := conn.(interface{ Unwrap() net.Conn })
+	if !ok {
+		t.Fatalf("connection %T cannot be unwrapped", conn)
+	}
+	if _, ok := w.Unwrap().(*net.TCPConn); !ok {
+		t.Fatalf("unexpected unwrapped connection: %T", w.Unwrap())
+	}
+}
+
+func TestBalancerSticky(t *testing.T) {
+	r := new(recorder)
+	b, err := dialer.NewBalancer(dialer.Sticky, r.source("a", 1), r.source("b", 1), r.source("c", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sources := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		host := "host" + strconv.Itoa(i) + ".example"
+		dial(t, b, host+":80").Close()
+		sources[host] = r.last()
+
+		// the port is not relevant
+		dial(t, b, host+":443").Close()
+		if r.last() != sources[host] {
+			t.Fatalf("%v: source changed: %v -> %v", host, sources[host], r.last())
+		}
+	}
+
+	b.Remove("a")
+	for host, s := range sources {
+		dial(t, b, host+":80").Close()
+		if s != "a" && r.last() != s {
+			t.Fatalf("%v: source changed after removing another one: %v -> %v", host, s, r.last())
+		}
+		if r.last() == "a" {
+			t.Fatalf("%v: removed source used", host)
+		}
+	}
+}
+
+func TestBalancerSources(t *testing.T) {
+	r := new(recorder)
+	b, err := dialer.NewBalancer(dialer.RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.DialContext(context.Background(), "tcp", "192.0.2.1:80"); err != dialer.ErrNoSources {
+		t.Fatalf("unexpected error: wanted %v, found %v", dialer.ErrNoSources, err)
+	}
+
+	if err := b.Add(r.source("a", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(r.source("a", 1)); err == nil {
+		t.Fatal("duplicate source added")
+	}
+	if b.Remove("b") {
+		t.Fatal("unknown source removed")
+	}
+	if s := b.Sources(); len(s) != 1 || s[0].Name != "a" {
+		t.Fatalf("unexpected sources: %v", s)
+	}
+
+	dial(t, b, "192.0.2.1:80").Close()
+	if !b.Remove("a") {
+		t.Fatal("source not removed")
+	}
+	if len(b.Sources()) != 0 {
+		t.Fatalf("unexpected sources: %v", b.Sources())
+	}
+}
+
+func TestLocal(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	l := &dialer.Local{IP: net.IPv4(127, 0, 0, 1)}
+	conn := dial(t, l, ln.Addr().String())
+	defer conn.Close()
+
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(l.IP) {
+		t.Fatalf("unexpected local address: wanted %v, found %v", l.IP, ip)
+	}
+
+	// IPv6 destinations are not reachable from an IPv4 address
+	if _, err := l.DialContext(context.Background(), "tcp", "[::1]:80"); err == nil {
+		t.Fatal("expected error")
+	}
+}
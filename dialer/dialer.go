@@ -27,12 +27,22 @@ package dialer
 
 import (
 	"context"
+	"errors"
 	"net"
 )
 
 // Default provides a default dialer implementation ready to be used.
 var Default = new(net.Dialer)
 
+// ErrNotAllowed is returned by dialers that refuse to open a connection
+// because of their policy.
+var ErrNotAllowed = errors.New("dialer: connection not allowed")
+
+// ErrUnreachable is returned, usually wrapped, by dialers that could not
+// reach the destination of a connection, although the dialer itself
+// works, e.g. when an upstream proxy reports that the host is unreachable.
+var ErrUnreachable = errors.New("dialer: destination unreachable")
+
 // Dialer is the interface that wraps the DialContext function.
 type Dialer interface {
 	// DialContext opens a connection to addr, which should
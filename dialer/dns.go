@@ -0,0 +1,375 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dialer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DefaultDNSTimeout is the maximum duration of a resolution performed by
+// a DNS resolver that does not specify one.
+const DefaultDNSTimeout = 5 * time.Second
+
+// DNS is a Resolver that queries a DNS server directly, using one of the
+// supported transports:
+//   - "udp", plain DNS, falling back to TCP for truncated responses
+//   - "tcp", plain DNS over TCP
+//   - "tls", DNS over TLS, see RFC 7858
+//   - "https", DNS over HTTPS, see RFC 8484
+type DNS struct {
+	// Net is the transport used.
+	Net string
+	// Addr is the address of the server, in the host:port form, or
+	// the URL of the endpoint with the https transport.
+	Addr string
+
+	// TLSConfig is used by the tls transport. If it does not specify
+	// a ServerName, the server certificate is verified against the
+	// host of Addr.
+	TLSConfig *tls.Config
+	// Client is used by the https transport. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+	// Dialer is used to connect to the server by the other transports.
+	// If nil, Default is used.
+	Dialer Dialer
+
+	// Timeout is the maximum duration of a resolution. If zero,
+	// DefaultDNSTimeout is used.
+	Timeout time.Duration
+}
+
+// NewDNS returns a DNS resolver that queries the server at addr using
+// the transport net.
+func NewDNS(net, addr string) *DNS {
+	return &DNS{Net: net, Addr: addr}
+}
+
+// ParseResolver returns the Resolver described by s, which is either
+// "system", see System, or an URL whose scheme is one of the transports
+// supported by DNS, e.g. "udp://192.0.2.1", "tls://192.0.2.1:853" or
+// "https://dns.example/dns-query". The standard ports are used when
+// missing.
+func ParseResolver(s string) (Resolver, error) {
+	if s == "system" {
+		return System, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, errors.New("ParseResolver: " + err.Error())
+	}
+	if u.Host == "" {
+		return nil, errors.New("ParseResolver: missing host in " + s)
+	}
+
+	host := u.Host
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "53")
+		}
+	case "tls":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "853")
+		}
+	case "https":
+		return NewDNS("https", s), nil
+	default:
+		return nil, errors.New("ParseResolver: unsupported transport: " + u.Scheme)
+	}
+	return NewDNS(u.Scheme, host), nil
+}
+
+func (d *DNS) dialer() Dialer {
+	if d.Dialer == nil {
+		return Default
+	}
+	return d.Dialer
+}
+
+// Resolve queries the server for both the IPv4 and the IPv6 addresses of
+// host. The duration returned is the smallest TTL of the records found or,
+// for hosts that do not exist, the negative caching TTL of the zone.
+func (d *DNS) Resolve(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = DefaultDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+	name, err := dnsmessage.NewName(host)
+	if err != nil {
+		return nil, 0, errors.New("Resolve: " + err.Error())
+	}
+
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	c := make(chan result, 2)
+	for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		go func(t dnsmessage.Type) {
+			ips, ttl, err := d.query(ctx, name, t)
+			c <- result{ips, ttl, err}
+		}(t)
+	}
+
+	var (
+		ips      []net.IP
+		ttl      time.Duration = -1
+		firstErr error
+	)
+	for i := 0; i < 2; i++ {
+		res := <-c
+		if res.err != nil && !isNotFound(res.err) {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+		ips = append(ips, res.ips...)
+		if ttl < 0 || res.ttl < ttl {
+			ttl = res.ttl
+		}
+	}
+
+	switch {
+	case len(ips) > 0:
+		return ips, ttl, nil
+	case firstErr != nil:
+		return nil, 0, firstErr
+	default:
+		return nil, ttl, notFound(strings.TrimSuffix(host, "."))
+	}
+}
+
+// query asks for the records of type t of name. Hosts that do not exist,
+// or do not have any record of type t, result in a not found error.
+func (d *DNS) query(ctx context.Context, name dnsmessage.Name, t dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var id uint16
+	if d.Net != "https" {
+		// RFC 8484 recommends using 0 as ID, to improve caching
+		binary.Read(rand.Reader, binary.BigEndian, &id)
+	}
+	q := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: t, Class: dnsmessage.ClassINET},
+		},
+	}
+	req, err := q.Pack()
+	if err != nil {
+		return nil, 0, errors.New("query: " + err.Error())
+	}
+
+	var resp []byte
+	switch d.Net {
+	case "udp":
+		resp, err = d.exchangeUDP(ctx, req)
+	case "tcp", "tls":
+		resp, err = d.exchangeStream(ctx, req)
+	case "https":
+		resp, err = d.exchangeHTTPS(ctx, req)
+	default:
+		err = errors.New("unsupported transport: " + d.Net)
+	}
+	if err != nil {
+		return nil, 0, errors.New("query: " + err.Error())
+	}
+
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		return nil, 0, errors.New("query: " + err.Error())
+	}
+	if m.Header.ID != id || !m.Header.Response {
+		return nil, 0, errors.New("query: unexpected response")
+	}
+
+	switch m.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, negativeTTL(m), notFound(name.String())
+	default:
+		return nil, 0, errors.New("query: server failure, rcode " + strconv.Itoa(int(m.Header.RCode)))
+	}
+
+	var (
+		ips []net.IP
+		ttl time.Duration
+	)
+	for _, a := range m.Answers {
+		var ip net.IP
+		switch b := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(b.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(b.AAAA[:])
+		default:
+			continue // e.g. CNAME records
+		}
+		if rttl := time.Duration(a.Header.TTL) * time.Second; len(ips) == 0 || rttl < ttl {
+			ttl = rttl
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		return nil, negativeTTL(m), notFound(name.String())
+	}
+	return ips, ttl, nil
+}
+
+// negativeTTL returns the duration the absence of the records asked in m
+// can be cached for, see RFC 2308 section 5.
+func negativeTTL(m dnsmessage.Message) time.Duration {
+	for _, a := range m.Authorities {
+		if soa, ok := a.Body.(*dnsmessage.SOAResource); ok {
+			ttl := a.Header.TTL
+			if soa.MinTTL < ttl {
+				ttl = soa.MinTTL
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+	return DefaultNegativeTTL
+}
+
+func (d *DNS) exchangeUDP(ctx context.Context, req []byte) ([]byte, error) {
+	conn, err := d.dialer().DialContext(ctx, "udp", d.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 3 || !bytes.Equal(buf[:2], req[:2]) {
+			// not the response to this query
+			continue
+		}
+		if buf[2]&0x02 != 0 {
+			// truncated, see RFC 1035 section 4.2.1
+			tcp := *d
+			tcp.Net = "tcp"
+			return tcp.exchangeStream(ctx, req)
+		}
+		return buf[:n], nil
+	}
+}
+
+// exchangeStream performs the exchange over TCP or TLS, where messages
+// are prefixed by their length.
+func (d *DNS) exchangeStream(ctx context.Context, req []byte) ([]byte, error) {
+	conn, err := d.dialer().DialContext(ctx, "tcp", d.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if d.Net == "tls" {
+		config := &tls.Config{}
+		if d.TLSConfig != nil {
+			config = d.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(d.Addr)
+		}
+		conn = tls.Client(conn, config)
+	}
+
+	msg := make([]byte, 2+len(req))
+	binary.BigEndian.PutUint16(msg, uint16(len(req)))
+	copy(msg[2:], req)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(conn, msg[:2]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(msg))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (d *DNS) exchangeHTTPS(ctx context.Context, req []byte) ([]byte, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, d.Addr, bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/dns-message")
+	r.Header.Set("Accept", "application/dns-message")
+
+	c := d.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	resp, err := c.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected status: " + resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+}
@@ -0,0 +1,255 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dialer_test
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/booster-proj/proxy/dialer"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// zone answers the queries of the stand-in DNS servers.
+func zone(req []byte) []byte {
+	var q dnsmessage.Message
+	if err := q.Unpack(req); err != nil || len(q.Questions) != 1 {
+		return nil
+	}
+	question := q.Questions[0]
+
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: q.Header.ID, Response: true},
+		Questions: q.Questions,
+	}
+	rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET}
+
+	switch question.Name.String() {
+	case "example.test.":
+		switch question.Type {
+		case dnsmessage.TypeA:
+			rh.Type, rh.TTL = dnsmessage.TypeA, 300
+			m.Answers = append(m.Answers, dnsmessage.Resource{
+				Header: rh,
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			})
+		case dnsmessage.TypeAAAA:
+			rh.Type, rh.TTL = dnsmessage.TypeAAAA, 60
+			m.Answers = append(m.Answers, dnsmessage.Resource{
+				Header: rh,
+				Body:   &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}},
+			})
+		}
+	case "v4only.test.":
+		if question.Type == dnsmessage.TypeA {
+			rh.Type, rh.TTL = dnsmessage.TypeA, 120
+			m.Answers = append(m.Answers, dnsmessage.Resource{
+				Header: rh,
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}},
+			})
+		}
+	default:
+		m.Header.RCode = dnsmessage.RCodeNameError
+		rh.Name = dnsmessage.MustNewName("test.")
+		rh.Type, rh.TTL = dnsmessage.TypeSOA, 3600
+		m.Authorities = append(m.Authorities, dnsmessage.Resource{
+			Header: rh,
+			Body: &dnsmessage.SOAResource{
+				NS:     dnsmessage.MustNewName("ns.test."),
+				MBox:   dnsmessage.MustNewName("admin.test."),
+				MinTTL: 10,
+			},
+		})
+	}
+
+	b, _ := m.Pack()
+	return b
+}
+
+func serveUDP(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(zone(buf[:n]), addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func serveStream(t *testing.T, ln net.Listener) string {
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 2)
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				req := make([]byte, binary.BigEndian.Uint16(buf))
+				if _, err := io.ReadFull(conn, req); err != nil {
+					return
+				}
+				resp := zone(req)
+				binary.BigEndian.PutUint16(buf, uint16(len(resp)))
+				conn.Write(append(buf, resp...))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestDNS(t *testing.T) {
+	// borrow the certificate of a test server
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		req, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(zone(req))
+	}))
+	defer ts.Close()
+
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsLn, err := tls.Listen("tcp", "127.0.0.1:0", ts.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dot := dialer.NewDNS("tls", serveStream(t, tlsLn))
+	dot.TLSConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig
+	doh := dialer.NewDNS("https", ts.URL+"/dns-query")
+	doh.Client = ts.Client()
+
+	resolvers := map[string]*dialer.DNS{
+		"udp":   dialer.NewDNS("udp", serveUDP(t)),
+		"tcp":   dialer.NewDNS("tcp", serveStream(t, tcpLn)),
+		"tls":   dot,
+		"https": doh,
+	}
+
+	var tests = []struct {
+		host     string
+		ips      []string
+		ttl      time.Duration
+		notFound bool
+	}{
+		{host: "example.test", ips: []string{"192.0.2.1", "2001:db8::1"}, ttl: 60 * time.Second},
+		// the absence of AAAA records is cached for the default duration
+		{host: "v4only.test", ips: []string{"192.0.2.2"}, ttl: dialer.DefaultNegativeTTL},
+		{host: "missing.test", ttl: 10 * time.Second, notFound: true},
+	}
+
+	for name, r := range resolvers {
+		for _, test := range tests {
+			ips, ttl, err := r.Resolve(context.Background(), test.host)
+			if test.notFound {
+				if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+					t.Fatalf("%v %v: unexpected error: %v", name, test.host, err)
+				}
+			} else if err != nil {
+				t.Fatalf("%v %v: %v", name, test.host, err)
+			}
+
+			var found []string
+			for _, ip := range ips {
+				found = append(found, ip.String())
+			}
+			sort.Strings(found)
+			if len(found) != len(test.ips) || (len(found) > 0 && found[0] != test.ips[0]) {
+				t.Fatalf("%v %v: unexpected addresses: wanted %v, found %v", name, test.host, test.ips, found)
+			}
+			if ttl != test.ttl {
+				t.Fatalf("%v %v: unexpected ttl: wanted %v, found %v", name, test.host, test.ttl, ttl)
+			}
+		}
+	}
+}
+
+func TestParseResolver(t *testing.T) {
+	var tests = []struct {
+		in   string
+		net  string
+		addr string
+		err  bool
+	}{
+		{in: "udp://192.0.2.1", net: "udp", addr: "192.0.2.1:53"},
+		{in: "tcp://192.0.2.1:5353", net: "tcp", addr: "192.0.2.1:5353"},
+		{in: "tls://[2001:db8::1]", net: "tls", addr: "[2001:db8::1]:853"},
+		{in: "https://dns.example/dns-query", net: "https", addr: "https://dns.example/dns-query"},
+		{in: "ftp://192.0.2.1", err: true},
+		{in: "192.0.2.1", err: true},
+	}
+
+	for _, test := range tests {
+		r, err := dialer.ParseResolver(test.in)
+		if test.err {
+			if err == nil {
+				t.Fatalf("%v: expected error", test.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", test.in, err)
+		}
+		d := r.(*dialer.DNS)
+		if d.Net != test.net || d.Addr != test.addr {
+			t.Fatalf("%v: unexpected resolver: wanted %v %v, found %v %v", test.in, test.net, test.addr, d.Net, d.Addr)
+		}
+	}
+
+	if r, err := dialer.ParseResolver("system"); err != nil || r != dialer.System {
+		t.Fatalf("unexpected system resolver: %v, %v", r, err)
+	}
+}
@@ -0,0 +1,289 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrUnavailable is returned by a Failover when all its paths are
+// unavailable, i.e. their circuit breakers are open.
+var ErrUnavailable = errors.New("dialer: all paths unavailable")
+
+// Default values used by Failover.
+const (
+	DefaultThreshold = 5
+	DefaultCooldown  = 30 * time.Second
+)
+
+// State is the state of the circuit breaker of a path.
+type State uint8
+
+// Possible State values.
+const (
+	// Closed paths are used normally.
+	Closed State = iota
+	// Open paths failed repeatedly, and are not used until their
+	// cooldown expires.
+	Open
+	// HalfOpen paths are being probed by a single connection attempt,
+	// whose result decides whether they are closed or opened again.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// Path is one of the dialers of a Failover.
+type Path struct {
+	// Name identifies the path.
+	Name   string
+	Dialer Dialer
+}
+
+// path stores the state of the circuit breaker of a Path.
+type path struct {
+	Path
+	state    State
+	failures int       // consecutive
+	openedAt time.Time // when the breaker tripped
+	probing  bool      // a half-open attempt is in progress
+}
+
+// Failover is a Dialer that tries its paths in order, until one of them
+// succeeds. Each path is protected by a circuit breaker, that stops using
+// it after repeated failures, and probes it again after a cooldown.
+//
+// The fields must not be modified while the Failover is in use.
+type Failover struct {
+	// Attempts is the maximum number of attempts performed by each
+	// DialContext call. When it exceeds the number of paths, the paths
+	// are tried again from the beginning. If zero, each path is tried
+	// once.
+	Attempts int
+	// AttemptTimeout, if not zero, is the maximum duration of each
+	// attempt.
+	AttemptTimeout time.Duration
+
+	// Threshold is the number of consecutive failures that trips the
+	// circuit breaker of a path. If zero, DefaultThreshold is used.
+	Threshold int
+	// Cooldown is the duration an open path is not used for. If zero,
+	// DefaultCooldown is used.
+	Cooldown time.Duration
+
+	// OnStateChange, if not nil, is called when the circuit breaker
+	// of a path changes state.
+	OnStateChange func(path string, from, to State)
+
+	mu    sync.Mutex
+	paths []*path
+}
+
+// NewFailover returns a Failover that tries paths in order.
+func NewFailover(paths ...Path) *Failover {
+	f := new(Failover)
+	for _, p := range paths {
+		f.paths = append(f.paths, &path{Path: p})
+	}
+	return f
+}
+
+// State returns the state of the circuit breaker of the path called name.
+func (f *Failover) State(name string) (State, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, p := range f.paths {
+		if p.Name == name {
+			return p.state, true
+		}
+	}
+	return Closed, false
+}
+
+func (f *Failover) threshold() int {
+	if f.Threshold == 0 {
+		return DefaultThreshold
+	}
+	return f.Threshold
+}
+
+func (f *Failover) cooldown() time.Duration {
+	if f.Cooldown == 0 {
+		return DefaultCooldown
+	}
+	return f.Cooldown
+}
+
+// transition records a state change, to be notified after releasing
+// the lock.
+type transition struct {
+	path     string
+	from, to State
+}
+
+func (f *Failover) notify(ts []transition) {
+	if f.OnStateChange == nil {
+		return
+	}
+	for _, t := range ts {
+		f.OnStateChange(t.path, t.from, t.to)
+	}
+}
+
+// DialContext dials addr using the first available path that succeeds.
+// Errors caused by the policy of a path, i.e. ErrNotAllowed, or reported
+// by the path as caused by the destination, i.e. ErrUnreachable, are
+// returned immediately, and are not considered failures of the path.
+func (f *Failover) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	attempts := f.Attempts
+	if attempts == 0 {
+		attempts = len(f.paths)
+	}
+
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		p, ok := f.acquire(i)
+		if !ok {
+			continue
+		}
+
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if f.AttemptTimeout > 0 {
+			actx, cancel = context.WithTimeout(ctx, f.AttemptTimeout)
+		}
+		conn, err := p.Dialer.DialContext(actx, network, addr)
+		cancel()
+
+		switch {
+		case err == nil:
+			f.release(p, true)
+			return conn, nil
+		case ctx.Err() != nil:
+			f.release(p, false)
+			return nil, ctx.Err()
+		case errors.Is(err, ErrNotAllowed):
+			f.release(p, false)
+			return nil, err
+		case errors.Is(err, ErrUnreachable):
+			// the path reached the destination, which
+			// would fail through the other paths too.
+			f.release(p, true)
+			return nil, err
+		}
+		f.fail(p)
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		return nil, ErrUnavailable
+	}
+	return nil, lastErr
+}
+
+// acquire returns the path to be used by the i-th attempt, if available.
+func (f *Failover) acquire(i int) (*path, bool) {
+	var ts []transition
+	defer func() { f.notify(ts) }()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.paths) == 0 {
+		return nil, false
+	}
+	p := f.paths[i%len(f.paths)]
+
+	switch p.state {
+	case Open:
+		if time.Since(p.openedAt) < f.cooldown() {
+			return nil, false
+		}
+		ts = append(ts, transition{p.Name, Open, HalfOpen})
+		p.state = HalfOpen
+		p.probing = true
+		return p, true
+	case HalfOpen:
+		if p.probing {
+			return nil, false
+		}
+		p.probing = true
+		return p, true
+	default:
+		return p, true
+	}
+}
+
+// release records the result of an attempt that did not fail because of
+// the path. The path is closed if ok is true.
+func (f *Failover) release(p *path, ok bool) {
+	var ts []transition
+	defer func() { f.notify(ts) }()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p.probing = false
+	if !ok {
+		return
+	}
+	p.failures = 0
+	if p.state != Closed {
+		ts = append(ts, transition{p.Name, p.state, Closed})
+		p.state = Closed
+	}
+}
+
+// fail records a failure of p, tripping its breaker if needed.
+func (f *Failover) fail(p *path) {
+	var ts []transition
+	defer func() { f.notify(ts) }()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p.probing = false
+	p.failures++
+	if p.state == HalfOpen || (p.state == Closed && p.failures >= f.threshold()) {
+		ts = append(ts, transition{p.Name, p.state, Open})
+		p.state = Open
+		p.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,275 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dialer_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/booster-proj/proxy/dialer"
+	proxy_http "github.com/booster-proj/proxy/http"
+	"github.com/booster-proj/proxy/socks5"
+)
+
+// flaky is a dialer that fails while down is true.
+type flaky struct {
+	sync.Mutex
+	down  bool
+	calls int
+}
+
+func (f *flaky) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.calls++
+	if f.down {
+		return nil, errors.New("path down")
+	}
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func (f *flaky) set(down bool) {
+	f.Lock()
+	f.down = down
+	f.Unlock()
+}
+
+func (f *flaky) count() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.calls
+}
+
+// transitions records the state changes of a Failover.
+type transitions struct {
+	sync.Mutex
+	log []string
+}
+
+func (r *transitions) record(path string, from, to dialer.State) {
+	r.Lock()
+	r.log = append(r.log, path+": "+from.String()+" -> "+to.String())
+	r.Unlock()
+}
+
+func (r *transitions) check(t *testing.T, want ...string) {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.log) != len(want) {
+		t.Fatalf("unexpected transitions: wanted %q, found %q", want, r.log)
+	}
+	for i := range want {
+		if r.log[i] != want[i] {
+			t.Fatalf("unexpected transitions: wanted %q, found %q", want, r.log)
+		}
+	}
+}
+
+func TestFailoverBreaker(t *testing.T) {
+	primary, backup := &flaky{down: true}, new(flaky)
+	f := dialer.NewFailover(
+		dialer.Path{Name: "primary", Dialer: primary},
+		dialer.Path{Name: "backup", Dialer: backup},
+	)
+	f.Threshold = 2
+	f.Cooldown = 50 * time.Millisecond
+	var tr transitions
+	f.OnStateChange = tr.record
+
+	for i := 0; i < 3; i++ {
+		dial(t, f, "example.com:80").Close()
+	}
+	if n := primary.count(); n != 2 {
+		t.Fatalf("unexpected primary attempts: wanted 2, found %d", n)
+	}
+	if n := backup.count(); n != 3 {
+		t.Fatalf("unexpected backup attempts: wanted 3, found %d", n)
+	}
+	if s, _ := f.State("primary"); s != dialer.Open {
+		t.Fatalf("unexpected primary state: wanted %v, found %v", dialer.Open, s)
+	}
+	tr.check(t, "primary: closed -> open")
+
+	// a failed probe opens the breaker again.
+	time.Sleep(60 * time.Millisecond)
+	dial(t, f, "example.com:80").Close()
+	dial(t, f, "example.com:80").Close()
+	if n := primary.count(); n != 3 {
+		t.Fatalf("unexpected primary attempts: wanted 3, found %d", n)
+	}
+
+	// a successful probe closes it.
+	primary.set(false)
+	time.Sleep(60 * time.Millisecond)
+	dial(t, f, "example.com:80").Close()
+	if n := backup.count(); n != 5 {
+		t.Fatalf("unexpected backup attempts: wanted 5, found %d", n)
+	}
+	tr.check(t,
+		"primary: closed -> open",
+		"primary: open -> half-open",
+		"primary: half-open -> open",
+		"primary: open -> half-open",
+		"primary: half-open -> closed",
+	)
+}
+
+func TestFailoverAttempts(t *testing.T) {
+	hang := dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	deny := dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, dialer.ErrNotAllowed
+	})
+	down := &flaky{down: true}
+
+	var tests = []struct {
+		paths    []dialer.Path
+		attempts int
+		calls    int
+		err      error
+	}{
+		// retries restart from the first path.
+		{paths: []dialer.Path{{Name: "a", Dialer: down}}, attempts: 3, calls: 3},
+		// the attempt timeout moves on to the next path.
+		{paths: []dialer.Path{{Name: "a", Dialer: hang}, {Name: "b", Dialer: down}}, calls: 1},
+		// policy errors are not retried.
+		{paths: []dialer.Path{{Name: "a", Dialer: deny}, {Name: "b", Dialer: down}}, err: dialer.ErrNotAllowed},
+		{err: dialer.ErrUnavailable},
+	}
+
+	for i, test := range tests {
+		down.Lock()
+		down.calls = 0
+		down.Unlock()
+
+		f := dialer.NewFailover(test.paths...)
+		f.Attempts = test.attempts
+		f.AttemptTimeout = 20 * time.Millisecond
+
+		_, err := f.DialContext(context.Background(), "tcp", "example.com:80")
+		if err == nil {
+			t.Fatalf("%d: expected an error", i)
+		}
+		if test.err != nil && !errors.Is(err, test.err) {
+			t.Fatalf("%d: unexpected error: wanted %v, found %v", i, test.err, err)
+		}
+		if n := down.count(); n != test.calls {
+			t.Fatalf("%d: unexpected attempts: wanted %d, found %d", i, test.calls, n)
+		}
+	}
+}
+
+func TestFailoverUnavailable(t *testing.T) {
+	f := dialer.NewFailover(dialer.Path{Name: "a", Dialer: &flaky{down: true}})
+	f.Threshold = 1
+
+	if _, err := f.DialContext(context.Background(), "tcp", "example.com:80"); err == nil || err == dialer.ErrUnavailable {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := f.DialContext(context.Background(), "tcp", "example.com:80"); err != dialer.ErrUnavailable {
+		t.Fatalf("unexpected error: wanted %v, found %v", dialer.ErrUnavailable, err)
+	}
+}
+
+func TestFailoverDestinationErrors(t *testing.T) {
+	// a port nobody listens on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := ln.Addr().String()
+	ln.Close()
+
+	fail := func(err error) dialer.Dialer {
+		return dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, err
+		})
+	}
+
+	var tests = []struct {
+		name   string
+		dialer dialer.Dialer
+		open   bool
+	}{
+		// errors reported by the path as caused by the destination.
+		{name: "wrapped", dialer: fail(&net.OpError{Op: "dial", Net: "tcp", Err: dialer.ErrUnreachable})},
+		{name: "socks5 host unreachable", dialer: fail(&socks5.ReplyError{Code: 4})},
+		{name: "http bad gateway", dialer: fail(&proxy_http.StatusError{StatusCode: http.StatusBadGateway})},
+
+		// the other errors are failures of the path.
+		{name: "down", dialer: &flaky{down: true}, open: true},
+		{name: "refused", dialer: dialer.Default, open: true},
+		{name: "socks5 upstream down", dialer: socks5.NewClient(refused), open: true},
+		{name: "http upstream down", dialer: proxy_http.NewClient(refused), open: true},
+		{name: "socks5 failure", dialer: fail(&socks5.ReplyError{Code: 1}), open: true},
+		{name: "http unavailable", dialer: fail(&proxy_http.StatusError{StatusCode: http.StatusServiceUnavailable}), open: true},
+	}
+
+	for _, test := range tests {
+		backup := new(flaky)
+		f := dialer.NewFailover(
+			dialer.Path{Name: "primary", Dialer: test.dialer},
+			dialer.Path{Name: "backup", Dialer: backup},
+		)
+		f.Threshold = 1
+		var tr transitions
+		f.OnStateChange = tr.record
+
+		// the destination is refused when dialed directly.
+		_, err := f.DialContext(context.Background(), "tcp", refused)
+		if test.open {
+			if err != nil {
+				t.Fatalf("%v: unexpected error: %v", test.name, err)
+			}
+			if n := backup.count(); n != 1 {
+				t.Fatalf("%v: unexpected backup attempts: wanted 1, found %d", test.name, n)
+			}
+			tr.check(t, "primary: closed -> open")
+			continue
+		}
+
+		if err == nil {
+			t.Fatalf("%v: expected an error", test.name)
+		}
+		if n := backup.count(); n != 0 {
+			t.Fatalf("%v: unexpected backup attempts: wanted 0, found %d", test.name, n)
+		}
+		if s, _ := f.State("primary"); s != dialer.Closed {
+			t.Fatalf("%v: unexpected primary state: wanted %v, found %v", test.name, dialer.Closed, s)
+		}
+		tr.check(t)
+	}
+}
@@ -0,0 +1,310 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Family is an IP address family.
+type Family uint8
+
+// Possible Family values.
+const (
+	IPv6 Family = iota
+	IPv4
+)
+
+func (f Family) String() string {
+	switch f {
+	case IPv6:
+		return "ipv6"
+	case IPv4:
+		return "ipv4"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseFamily returns the Family called s, i.e. "ipv4" or "ipv6".
+func ParseFamily(s string) (Family, error) {
+	for _, f := range []Family{IPv6, IPv4} {
+		if f.String() == s {
+			return f, nil
+		}
+	}
+	return IPv6, errors.New("ParseFamily: unknown family: " + s)
+}
+
+func familyOf(ip net.IP) Family {
+	if ip.To4() != nil {
+		return IPv4
+	}
+	return IPv6
+}
+
+// Default values used by HappyEyeballs, as recommended by RFC 8305.
+const (
+	DefaultAttemptDelay = 250 * time.Millisecond
+	MinAttemptDelay     = 10 * time.Millisecond
+	DefaultFamilyMemory = 10 * time.Minute
+)
+
+// maxRecent is the number of hosts above which expired entries are
+// removed from the memory of a HappyEyeballs dialer.
+const maxRecent = 1024
+
+// HappyEyeballs is a Dialer that races the IPv6 and IPv4 addresses of
+// the host names it is asked to connect to, following RFC 8305: the
+// addresses are interleaved by family, and a new connection attempt is
+// started each time the previous one fails or AttemptDelay elapses. The
+// first connection established is returned, the others are closed.
+//
+// The fields must not be modified while the dialer is in use.
+type HappyEyeballs struct {
+	Resolver Resolver
+	Dialer   Dialer
+
+	// Prefer is the family of the first address tried. Defaults to
+	// IPv6.
+	Prefer Family
+	// AttemptDelay is the time to wait before starting the next
+	// connection attempt. If zero, DefaultAttemptDelay is used. Values
+	// lower than MinAttemptDelay are raised to it.
+	AttemptDelay time.Duration
+	// FamilyMemory is the duration the family that succeeded last for
+	// a host is preferred for, when connecting to that host again. If
+	// zero, DefaultFamilyMemory is used; if negative, the preference
+	// is always Prefer.
+	FamilyMemory time.Duration
+
+	mu     sync.Mutex
+	recent map[string]recentFamily
+}
+
+type recentFamily struct {
+	family Family
+	expiry time.Time
+}
+
+// NewHappyEyeballs returns a HappyEyeballs dialer that uses r to resolve
+// host names, and d to dial the addresses obtained. If r is nil, System
+// is used; if d is nil, Default is used.
+func NewHappyEyeballs(r Resolver, d Dialer) *HappyEyeballs {
+	if r == nil {
+		r = System
+	}
+	if d == nil {
+		d = Default
+	}
+	return &HappyEyeballs{Resolver: r, Dialer: d}
+}
+
+func (h *HappyEyeballs) attemptDelay() time.Duration {
+	switch {
+	case h.AttemptDelay == 0:
+		return DefaultAttemptDelay
+	case h.AttemptDelay < MinAttemptDelay:
+		return MinAttemptDelay
+	default:
+		return h.AttemptDelay
+	}
+}
+
+func (h *HappyEyeballs) familyMemory() time.Duration {
+	if h.FamilyMemory == 0 {
+		return DefaultFamilyMemory
+	}
+	return h.FamilyMemory
+}
+
+// preferred returns the family to try first when connecting to host.
+func (h *HappyEyeballs) preferred(host string) Family {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r, ok := h.recent[host]
+	if !ok {
+		return h.Prefer
+	}
+	if time.Now().After(r.expiry) {
+		delete(h.recent, host)
+		return h.Prefer
+	}
+	return r.family
+}
+
+// remember records that a connection to host succeeded using family.
+func (h *HappyEyeballs) remember(host string, family Family) {
+	if h.familyMemory() < 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if h.recent == nil {
+		h.recent = make(map[string]recentFamily)
+	}
+	if len(h.recent) >= maxRecent {
+		for k, r := range h.recent {
+			if now.After(r.expiry) {
+				delete(h.recent, k)
+			}
+		}
+	}
+	h.recent[host] = recentFamily{family: family, expiry: now.Add(h.familyMemory())}
+}
+
+// DialContext resolves the host contained in addr, if it is not an IP
+// address, and races the addresses obtained.
+func (h *HappyEyeballs) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return h.Dialer.DialContext(ctx, network, addr)
+	}
+
+	ips, _, err := h.Resolver.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips = filterIPs(network, ips)
+	if len(ips) == 0 {
+		return nil, notFound(host)
+	}
+
+	conn, ip, err := h.race(ctx, network, port, interleave(ips, h.preferred(host)))
+	if err != nil {
+		return nil, err
+	}
+	h.remember(host, familyOf(ip))
+	return conn, nil
+}
+
+// interleave sorts ips alternating their families, starting with first,
+// and preserving the order of the addresses of each family.
+func interleave(ips []net.IP, first Family) []net.IP {
+	var a, b []net.IP
+	for _, ip := range ips {
+		if familyOf(ip) == first {
+			a = append(a, ip)
+		} else {
+			b = append(b, ip)
+		}
+	}
+
+	res := make([]net.IP, 0, len(ips))
+	for len(a) > 0 || len(b) > 0 {
+		if len(a) > 0 {
+			res, a = append(res, a[0]), a[1:]
+		}
+		if len(b) > 0 {
+			res, b = append(res, b[0]), b[1:]
+		}
+	}
+	return res
+}
+
+type attempt struct {
+	conn net.Conn
+	ip   net.IP
+	err  error
+}
+
+// race dials ips, starting a new attempt each time one fails or the
+// attempt delay elapses, and returns the first connection established
+// together with its address. If all the attempts fail, the first error
+// is returned.
+func (h *HappyEyeballs) race(ctx context.Context, network, port string, ips []net.IP) (net.Conn, net.IP, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan attempt, len(ips))
+	next, pending := 0, 0
+	var firstErr error
+
+	for {
+		if next < len(ips) {
+			ip := ips[next]
+			next++
+			pending++
+			go func() {
+				conn, err := h.Dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+				results <- attempt{conn: conn, ip: ip, err: err}
+			}()
+		}
+		if pending == 0 {
+			return nil, nil, firstErr
+		}
+
+		var timer *time.Timer
+		var delay <-chan time.Time
+		if next < len(ips) {
+			timer = time.NewTimer(h.attemptDelay())
+			delay = timer.C
+		}
+
+		var r attempt
+		select {
+		case r = <-results:
+			pending--
+		case <-delay:
+			continue
+		case <-ctx.Done():
+			r.err = ctx.Err()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		switch {
+		case r.err == nil:
+			go discard(results, pending)
+			return r.conn, r.ip, nil
+		case ctx.Err() != nil:
+			go discard(results, pending)
+			return nil, nil, ctx.Err()
+		case firstErr == nil:
+			firstErr = r.err
+		}
+	}
+}
+
+// discard closes the connections of the n attempts still pending.
+func discard(results <-chan attempt, n int) {
+	for ; n > 0; n-- {
+		if r := <-results; r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
@@ -0,0 +1,166 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dialer_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/booster-proj/proxy/dialer"
+)
+
+// racer is a dialer whose behaviour depends on the address dialed:
+// "ok" connects, "fail" fails immediately, "hang" waits for the
+// context to be canceled.
+type racer struct {
+	sync.Mutex
+	behaviour map[string]string
+	dialed    []string
+}
+
+func (r *racer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	r.Lock()
+	r.dialed = append(r.dialed, host)
+	b := r.behaviour[host]
+	r.Unlock()
+
+	switch b {
+	case "ok":
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	case "hang":
+		<-ctx.Done()
+		return nil, ctx.Err()
+	default:
+		return nil, errors.New("unreachable: " + host)
+	}
+}
+
+func (r *racer) order() []string {
+	r.Lock()
+	defer r.Unlock()
+	res := r.dialed
+	r.dialed = nil
+	return res
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	stub := &stubResolver{ips: map[string][]net.IP{
+		"dual.test": {net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), net.ParseIP("192.0.2.1")},
+	}}
+
+	var tests = []struct {
+		behaviour map[string]string
+		prefer    dialer.Family
+		order     []string
+		ok        bool
+		minDelay  time.Duration
+	}{
+		// IPv6 hangs, IPv4 is tried after the attempt delay.
+		{
+			behaviour: map[string]string{"2001:db8::1": "hang", "192.0.2.1": "ok"},
+			order:     []string{"2001:db8::1", "192.0.2.1"},
+			ok:        true,
+			minDelay:  100 * time.Millisecond,
+		},
+		// failures start the next attempt immediately, alternating families.
+		{
+			behaviour: map[string]string{},
+			order:     []string{"2001:db8::1", "192.0.2.1", "2001:db8::2"},
+		},
+		{
+			behaviour: map[string]string{"2001:db8::1": "fail", "192.0.2.1": "ok"},
+			order:     []string{"2001:db8::1", "192.0.2.1"},
+			ok:        true,
+		},
+		{
+			behaviour: map[string]string{"192.0.2.1": "ok"},
+			prefer:    dialer.IPv4,
+			order:     []string{"192.0.2.1"},
+			ok:        true,
+		},
+	}
+
+	for i, test := range tests {
+		r := &racer{behaviour: test.behaviour}
+		h := dialer.NewHappyEyeballs(stub, r)
+		h.Prefer = test.prefer
+		h.AttemptDelay = 100 * time.Millisecond
+
+		start := time.Now()
+		conn, err := h.DialContext(context.Background(), "tcp", "dual.test:80")
+		if test.ok != (err == nil) {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		if d := time.Since(start); d < test.minDelay || d > test.minDelay+80*time.Millisecond {
+			t.Fatalf("%d: unexpected dial duration: %v", i, d)
+		}
+
+		order := r.order()
+		if len(order) != len(test.order) {
+			t.Fatalf("%d: unexpected attempts: wanted %v, found %v", i, test.order, order)
+		}
+		for j := range order {
+			if order[j] != test.order[j] {
+				t.Fatalf("%d: unexpected attempts: wanted %v, found %v", i, test.order, order)
+			}
+		}
+	}
+}
+
+func TestHappyEyeballsMemory(t *testing.T) {
+	stub := &stubResolver{ips: map[string][]net.IP{
+		"dual.test": {net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")},
+	}}
+	r := &racer{behaviour: map[string]string{"2001:db8::1": "fail", "192.0.2.1": "ok"}}
+	h := dialer.NewHappyEyeballs(stub, r)
+	h.FamilyMemory = 50 * time.Millisecond
+
+	var tests = []struct {
+		sleep time.Duration
+		first string
+	}{
+		{first: "2001:db8::1"},
+		{first: "192.0.2.1"}, // IPv4 succeeded recently
+		{sleep: 60 * time.Millisecond, first: "2001:db8::1"},
+	}
+
+	for i, test := range tests {
+		time.Sleep(test.sleep)
+		dial(t, h, "dual.test:80").Close()
+		if order := r.order(); order[0] != test.first {
+			t.Fatalf("%d: unexpected first attempt: wanted %v, found %v", i, test.first, order)
+		}
+	}
+}
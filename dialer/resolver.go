@@ -0,0 +1,325 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver resolves host names into IP addresses.
+type Resolver interface {
+	// Resolve returns the addresses of host, together with the
+	// duration they can be cached for. If host does not exist, the
+	// error returned is a *net.DNSError with IsNotFound set, and the
+	// duration is the one the absence can be cached for.
+	Resolve(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+}
+
+// SystemTTL is the duration the addresses returned by System can be
+// cached for, as the system resolver does not report it.
+const SystemTTL = time.Minute
+
+// System is the Resolver that uses the resolver of the system,
+// see net.DefaultResolver.
+var System Resolver = systemResolver{}
+
+type systemResolver struct{}
+
+func (systemResolver) Resolve(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, SystemTTL, err
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, SystemTTL, nil
+}
+
+// notFound returns the error returned by resolvers when host does not
+// exist.
+func notFound(host string) error {
+	return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// isNotFound reports whether err tells that a host does not exist.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// DefaultNegativeTTL is the duration the absence of a host is cached
+// for, when the resolver does not report one.
+const DefaultNegativeTTL = 30 * time.Second
+
+// DefaultMaxCacheEntries is the default maximum number of hosts stored
+// by a Cache.
+const DefaultMaxCacheEntries = 10000
+
+// minSweepInterval is the minimum time between two removals of the
+// expired entries of a Cache.
+const minSweepInterval = time.Second
+
+// Cache is a Resolver that caches the responses of another Resolver, for
+// the duration reported by it. The absence of a host is cached too. Other
+// errors are not cached.
+//
+// Expired entries are removed when new ones are added. When the cache is
+// full, random entries are evicted.
+type Cache struct {
+	Resolver Resolver
+
+	// MaxTTL, if not zero, limits the duration the entries are
+	// cached for.
+	MaxTTL time.Duration
+	// NegativeTTL, if not zero, is the duration the absence of a
+	// host is cached for, instead of the one reported by Resolver.
+	NegativeTTL time.Duration
+	// MaxEntries is the maximum number of hosts stored. If zero,
+	// DefaultMaxCacheEntries is used.
+	MaxEntries int
+
+	mu        sync.Mutex
+	entries   map[string]*cacheEntry
+	nextSweep time.Time // when expired entries have to be removed
+}
+
+type cacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+	ready   chan struct{} // closed when the resolution is done
+}
+
+// NewCache returns a Cache of the responses of r.
+func NewCache(r Resolver) *Cache {
+	return &Cache{Resolver: r}
+}
+
+// Resolve returns the cached addresses of host, if present and not
+// expired, otherwise resolves them with the underlying resolver.
+// Concurrent resolutions of the same host are performed only once.
+func (c *Cache) Resolve(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	key := strings.ToLower(host)
+
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]*cacheEntry)
+	}
+	e, ok := c.entries[key]
+	if ok {
+		select {
+		case <-e.ready:
+			if time.Now().After(e.expires) {
+				ok = false
+			}
+		default:
+		}
+	}
+	if !ok {
+		c.makeRoom()
+		e = &cacheEntry{ready: make(chan struct{})}
+		c.entries[key] = e
+		c.mu.Unlock()
+
+		go c.resolve(host, key, e)
+	} else {
+		c.mu.Unlock()
+	}
+
+	select {
+	case <-e.ready:
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+	return e.ips, time.Until(e.expires), e.err
+}
+
+// resolve fills e, which is removed from the cache if the resolution
+// fails with an error that cannot be cached.
+func (c *Cache) resolve(host, key string, e *cacheEntry) {
+	// the resolution is shared by the callers, and cannot be bound
+	// to the context of one of them.
+	ips, ttl, err := c.Resolver.Resolve(context.Background(), host)
+	if err != nil && isNotFound(err) && c.NegativeTTL != 0 {
+		ttl = c.NegativeTTL
+	}
+	if c.MaxTTL != 0 && ttl > c.MaxTTL {
+		ttl = c.MaxTTL
+	}
+	e.ips, e.err, e.expires = ips, err, time.Now().Add(ttl)
+
+	c.mu.Lock()
+	if err != nil && !isNotFound(err) {
+		if c.entries[key] == e {
+			delete(c.entries, key)
+		}
+	} else if c.nextSweep.IsZero() || e.expires.Before(c.nextSweep) {
+		c.nextSweep = e.expires
+	}
+	c.mu.Unlock()
+	close(e.ready)
+}
+
+// makeRoom removes the expired entries, if some of them are, and evicts
+// random entries while the cache is full. Must be called with c.mu held.
+func (c *Cache) makeRoom() {
+	now := time.Now()
+	if !c.nextSweep.IsZero() && now.After(c.nextSweep) {
+		c.flush(now)
+	}
+
+	max := c.MaxEntries
+	if max == 0 {
+		max = DefaultMaxCacheEntries
+	}
+	for k := range c.entries {
+		if len(c.entries) < max {
+			break
+		}
+		// pending resolutions are evicted too, their callers
+		// still receive the result.
+		delete(c.entries, k)
+	}
+}
+
+// flush removes the expired entries, and schedules the next removal
+// when the first of the remaining ones expires. Must be called with
+// c.mu held.
+func (c *Cache) flush(now time.Time) {
+	c.nextSweep = time.Time{}
+	for k, e := range c.entries {
+		select {
+		case <-e.ready:
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			} else if c.nextSweep.IsZero() || e.expires.Before(c.nextSweep) {
+				c.nextSweep = e.expires
+			}
+		default:
+		}
+	}
+	if min := now.Add(minSweepInterval); !c.nextSweep.IsZero() && c.nextSweep.Before(min) {
+		c.nextSweep = min
+	}
+}
+
+// Flush removes the expired entries from the cache.
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.flush(time.Now())
+}
+
+// Len returns the number of hosts stored in the cache.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.entries)
+}
+
+// Resolving is a Dialer that resolves the host names it is asked to
+// connect to using Resolver, and then dials the addresses obtained in
+// order, using Dialer, until one of them succeeds.
+type Resolving struct {
+	Resolver Resolver
+	Dialer   Dialer
+}
+
+// NewResolving returns a Resolving dialer that uses r to resolve host
+// names, and d to dial the addresses obtained. If d is nil, Default is
+// used.
+func NewResolving(r Resolver, d Dialer) *Resolving {
+	if d == nil {
+		d = Default
+	}
+	return &Resolving{Resolver: r, Dialer: d}
+}
+
+// DialContext resolves the host contained in addr, if it is not an IP
+// address, and dials the addresses obtained.
+func (r *Resolving) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return r.Dialer.DialContext(ctx, network, addr)
+	}
+
+	ips, _, err := r.Resolver.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips = filterIPs(network, ips)
+	if len(ips) == 0 {
+		return nil, notFound(host)
+	}
+
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := r.Dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// filterIPs returns the addresses of ips that can be used with network.
+func filterIPs(network string, ips []net.IP) []net.IP {
+	var want4, want6 bool
+	switch {
+	case strings.HasSuffix(network, "4"):
+		want4 = true
+	case strings.HasSuffix(network, "6"):
+		want6 = true
+	default:
+		return ips
+	}
+
+	var res []net.IP
+	for _, ip := range ips {
+		if is4 := ip.To4() != nil; (is4 && want4) || (!is4 && want6) {
+			res = append(res, ip)
+		}
+	}
+	return res
+}
@@ -0,0 +1,207 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dialer_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/booster-proj/proxy/dialer"
+)
+
+// stubResolver returns fixed responses, counting the resolutions.
+type stubResolver struct {
+	sync.Mutex
+	ips   map[string][]net.IP
+	ttl   time.Duration
+	err   error
+	count int
+}
+
+func (r *stubResolver) Resolve(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.count++
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+	ips, ok := r.ips[host]
+	if !ok {
+		return nil, r.ttl, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, r.ttl, nil
+}
+
+func (r *stubResolver) resolutions() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.count
+}
+
+func TestCache(t *testing.T) {
+	stub := &stubResolver{
+		ips: map[string][]net.IP{"example.test": {net.IPv4(192, 0, 2, 1)}},
+		ttl: 100 * time.Millisecond,
+	}
+	c := dialer.NewCache(stub)
+
+	var tests = []struct {
+		host        string
+		sleep       time.Duration // before resolving
+		resolutions int           // total, after resolving
+		notFound    bool
+	}{
+		{host: "example.test", resolutions: 1},
+		{host: "EXAMPLE.test", resolutions: 1},
+		{host: "missing.test", resolutions: 2, notFound: true},
+		{host: "missing.test", resolutions: 2, notFound: true}, // negative caching
+		{host: "example.test", sleep: 150 * time.Millisecond, resolutions: 3},
+		{host: "missing.test", resolutions: 4, notFound: true},
+	}
+
+	for i, test := range tests {
+		time.Sleep(test.sleep)
+		ips, ttl, err := c.Resolve(context.Background(), test.host)
+		if test.notFound {
+			if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+				t.Fatalf("%d: unexpected error: %v", i, err)
+			}
+		} else if err != nil || len(ips) != 1 {
+			t.Fatalf("%d: unexpected response: %v, %v", i, ips, err)
+		}
+		if ttl <= 0 || ttl > stub.ttl {
+			t.Fatalf("%d: unexpected ttl: %v", i, ttl)
+		}
+		if n := stub.resolutions(); n != test.resolutions {
+			t.Fatalf("%d: unexpected resolutions: wanted %d, found %d", i, test.resolutions, n)
+		}
+	}
+
+	// failures are not cached
+	stub.Lock()
+	stub.err = errors.New("server failure")
+	stub.Unlock()
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.Resolve(context.Background(), "other.test"); err != stub.err {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if n := stub.resolutions(); n != 6 {
+		t.Fatalf("unexpected resolutions: wanted 6, found %d", n)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	// every host is missing, as random names sent by clients.
+	stub := &stubResolver{ttl: 50 * time.Millisecond}
+	c := dialer.NewCache(stub)
+	c.MaxEntries = 3
+
+	var tests = []struct {
+		sleep time.Duration // before resolving
+		host  string
+		len   int // after resolving
+	}{
+		{host: "a.test", len: 1},
+		{host: "b.test", len: 2},
+		{host: "c.test", len: 3},
+		{host: "d.test", len: 3},                                // full
+		{sleep: 100 * time.Millisecond, host: "e.test", len: 1}, // expired
+	}
+
+	for i, test := range tests {
+		time.Sleep(test.sleep)
+		c.Resolve(context.Background(), test.host)
+		if n := c.Len(); n != test.len {
+			t.Fatalf("%d: unexpected cache size: wanted %d, found %d", i, test.len, n)
+		}
+	}
+}
+
+func TestResolving(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	stub := &stubResolver{
+		ips: map[string][]net.IP{
+			// the first address refuses the connection
+			"example.test": {net.IPv6loopback, net.IPv4(127, 0, 0, 1)},
+		},
+		ttl: time.Minute,
+	}
+	d := dialer.NewResolving(stub, nil)
+
+	var tests = []struct {
+		network string
+		host    string
+		err     bool
+	}{
+		{network: "tcp", host: "example.test"},
+		{network: "tcp4", host: "example.test"},
+		{network: "tcp6", host: "example.test", err: true},
+		{network: "tcp", host: "missing.test", err: true},
+		{network: "tcp", host: "127.0.0.1"},
+	}
+
+	for _, test := range tests {
+		conn, err := d.DialContext(context.Background(), test.network, net.JoinHostPort(test.host, port))
+		if test.err {
+			if err == nil {
+				t.Fatalf("%v %v: expected error", test.network, test.host)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v %v: %v", test.network, test.host, err)
+		}
+		if addr := conn.RemoteAddr().String(); addr != ln.Addr().String() {
+			t.Fatalf("%v %v: unexpected address: %v", test.network, test.host, addr)
+		}
+		conn.Close()
+	}
+
+	// IP addresses are not resolved
+	if n := stub.resolutions(); n != 4 {
+		t.Fatalf("unexpected resolutions: wanted 4, found %d", n)
+	}
+}
@@ -0,0 +1,297 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	pathpkg "path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Block is the name of the route that refuses connections with
+// ErrNotAllowed.
+const Block = "block"
+
+// Matcher matches the destinations of connections.
+type Matcher interface {
+	// Match reports whether the connection to host and port should be
+	// routed by the rule. host is lower case, without trailing dot,
+	// and is not resolved: it may be a name or an IP address.
+	Match(host string, port int) bool
+}
+
+// Domain matches a domain and its subdomains, e.g. "example.com" matches
+// "example.com" and "www.example.com", but not "badexample.com".
+type Domain string
+
+func (d Domain) Match(host string, port int) bool {
+	s := strings.ToLower(strings.TrimSuffix(string(d), "."))
+	return host == s || strings.HasSuffix(host, "."+s)
+}
+
+// Glob matches host names using the syntax of path.Match, e.g.
+// "*.example.com". Note that * also matches dots.
+type Glob string
+
+func (g Glob) Match(host string, port int) bool {
+	ok, _ := pathpkg.Match(strings.ToLower(string(g)), host)
+	return ok
+}
+
+// Regexp matches host names with a regular expression.
+type Regexp regexp.Regexp
+
+func (r *Regexp) Match(host string, port int) bool {
+	return (*regexp.Regexp)(r).MatchString(host)
+}
+
+// CIDR matches the IP addresses of a network. As host names are not
+// resolved, it only matches destinations expressed as IP addresses.
+type CIDR net.IPNet
+
+func (c *CIDR) Match(host string, port int) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && (*net.IPNet)(c).Contains(ip)
+}
+
+// Ports matches the ports between Min and Max, inclusive.
+type Ports struct {
+	Min, Max int
+}
+
+func (p Ports) Match(host string, port int) bool {
+	return port >= p.Min && port <= p.Max
+}
+
+// All matches every destination.
+type All struct{}
+
+func (All) Match(host string, port int) bool {
+	return true
+}
+
+// Rule routes the destinations matched by Matcher through the dialer
+// called Route.
+type Rule struct {
+	Matcher
+	Route string
+}
+
+// Router is a Dialer that delegates each connection to the dialer of the
+// first of its rules that matches the destination.
+//
+// The fields must not be modified while the Router is in use.
+type Router struct {
+	Rules []Rule
+	// Dialers contains the dialers rules can route connections
+	// through, by name. Block does not need to be registered.
+	Dialers map[string]Dialer
+	// Default is used for the destinations not matched by any rule.
+	// If nil, those connections are refused with ErrNotAllowed.
+	Default Dialer
+}
+
+// NewRouter returns a Router that uses rules, and d when no rule matches.
+func NewRouter(d Dialer, rules ...Rule) *Router {
+	return &Router{
+		Rules:   rules,
+		Dialers: make(map[string]Dialer),
+		Default: d,
+	}
+}
+
+// Check returns an error if a rule uses a route that is not registered.
+func (r *Router) Check() error {
+	for _, rule := range r.Rules {
+		if _, ok := r.Dialers[rule.Route]; !ok && rule.Route != Block {
+			return errors.New("Check: unknown route: " + rule.Route)
+		}
+	}
+	return nil
+}
+
+// Route returns the name of the route used for addr, which is empty
+// when no rule matches.
+func (r *Router) Route(addr string) (string, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return "", errors.New("Route: invalid port: " + p)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, rule := range r.Rules {
+		if rule.Match(host, port) {
+			return rule.Route, nil
+		}
+	}
+	return "", nil
+}
+
+// DialContext dials addr using the dialer chosen by the rules.
+func (r *Router) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	route, err := r.Route(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d := r.Default
+	switch route {
+	case "":
+	case Block:
+		return nil, ErrNotAllowed
+	default:
+		var ok bool
+		if d, ok = r.Dialers[route]; !ok {
+			return nil, errors.New("DialContext: unknown route: " + route)
+		}
+	}
+	if d == nil {
+		return nil, ErrNotAllowed
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// ParseRule parses a rule in the "kind [pattern] route" form, where kind
+// is one of:
+//
+//	domain example.com    see Domain
+//	glob *.example.com    see Glob
+//	regex ^api[0-9]+\.    see Regexp
+//	cidr 10.0.0.0/8       see CIDR
+//	port 8000-8999        see Ports, also accepts a single port
+//	all                   see All, takes no pattern
+func ParseRule(s string) (Rule, error) {
+	var rule Rule
+	f := strings.Fields(s)
+	if len(f) == 2 && f[0] == "all" {
+		rule.Matcher, rule.Route = All{}, f[1]
+		return rule, nil
+	}
+	if len(f) != 3 {
+		return rule, errors.New("ParseRule: expected kind, pattern and route: " + s)
+	}
+	kind, pattern := f[0], f[1]
+	rule.Route = f[2]
+
+	switch kind {
+	case "domain":
+		rule.Matcher = Domain(pattern)
+	case "glob":
+		if _, err := pathpkg.Match(pattern, ""); err != nil {
+			return rule, errors.New("ParseRule: invalid glob: " + err.Error())
+		}
+		rule.Matcher = Glob(pattern)
+	case "regex":
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return rule, errors.New("ParseRule: invalid regex: " + err.Error())
+		}
+		rule.Matcher = (*Regexp)(re)
+	case "cidr":
+		_, n, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return rule, errors.New("ParseRule: " + err.Error())
+		}
+		rule.Matcher = (*CIDR)(n)
+	case "port":
+		p, err := parsePorts(pattern)
+		if err != nil {
+			return rule, errors.New("ParseRule: " + err.Error())
+		}
+		rule.Matcher = p
+	default:
+		return rule, errors.New("ParseRule: unknown kind: " + kind)
+	}
+	return rule, nil
+}
+
+func parsePorts(s string) (Ports, error) {
+	min, max := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		min, max = s[:i], s[i+1:]
+	}
+
+	var p Ports
+	var err error
+	if p.Min, err = strconv.Atoi(min); err != nil {
+		return p, errors.New("invalid port range: " + s)
+	}
+	if p.Max, err = strconv.Atoi(max); err != nil {
+		return p, errors.New("invalid port range: " + s)
+	}
+	if p.Min < 0 || p.Max > 65535 || p.Min > p.Max {
+		return p, errors.New("invalid port range: " + s)
+	}
+	return p, nil
+}
+
+// ParseRules parses the rules read from r, one per line, see ParseRule.
+// Empty lines and lines starting with # are ignored.
+func ParseRules(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := ParseRule(line)
+		if err != nil {
+			return nil, errors.New("line " + strconv.Itoa(n) + ": " + err.Error())
+		}
+		rules = append(rules, rule)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// LoadRules parses the rules stored in the file called name, see
+// ParseRules.
+func LoadRules(name string) ([]Rule, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, errors.New("LoadRules: " + err.Error())
+	}
+	defer f.Close()
+
+	rules, err := ParseRules(f)
+	if err != nil {
+		return nil, errors.New("LoadRules: " + name + ": " + err.Error())
+	}
+	return rules, nil
+}
@@ -0,0 +1,136 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dialer_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/booster-proj/proxy/dialer"
+)
+
+const rules = `
+# internal domains go direct
+domain corp.internal direct
+glob *.example.com socks
+regex ^api[0-9]+\.test$ direct
+cidr 10.0.0.0/8 direct
+port 6660-6669 block
+
+all http
+`
+
+func TestRouter(t *testing.T) {
+	rs, err := dialer.ParseRules(strings.NewReader(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r recorder
+	router := dialer.NewRouter(nil, rs...)
+	for _, name := range []string{"direct", "socks", "http"} {
+		router.Dialers[name] = r.source(name, 1).Dialer
+	}
+	if err := router.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		addr  string
+		route string
+	}{
+		{addr: "corp.internal:443", route: "direct"},
+		{addr: "wiki.CORP.internal.:80", route: "direct"},
+		{addr: "evilcorp.internal:80", route: "http"},
+		{addr: "www.example.com:443", route: "socks"},
+		{addr: "example.com:443", route: "http"},
+		{addr: "api42.test:80", route: "direct"},
+		{addr: "10.1.2.3:22", route: "direct"},
+		{addr: "[2001:db8::1]:22", route: "http"},
+		{addr: "irc.test:6667", route: "block"},
+	}
+
+	for _, test := range tests {
+		conn, err := router.DialContext(context.Background(), "tcp", test.addr)
+		if test.route == dialer.Block {
+			if err != dialer.ErrNotAllowed {
+				t.Fatalf("%v: unexpected error: wanted %v, found %v", test.addr, dialer.ErrNotAllowed, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", test.addr, err)
+		}
+		conn.Close()
+		if route := r.last(); route != test.route {
+			t.Fatalf("%v: unexpected route: wanted %v, found %v", test.addr, test.route, route)
+		}
+	}
+}
+
+func TestRouterDefault(t *testing.T) {
+	var r recorder
+	router := dialer.NewRouter(nil, dialer.Rule{Matcher: dialer.Domain("example.com"), Route: "upstream"})
+
+	if err := router.Check(); err == nil {
+		t.Fatal("expected an unknown route error")
+	}
+	router.Dialers["upstream"] = r.source("upstream", 1).Dialer
+
+	if _, err := router.DialContext(context.Background(), "tcp", "example.org:80"); err != dialer.ErrNotAllowed {
+		t.Fatalf("unexpected error: wanted %v, found %v", dialer.ErrNotAllowed, err)
+	}
+
+	router.Default = r.source("default", 1).Dialer
+	dial(t, router, "example.org:80").Close()
+	if route := r.last(); route != "default" {
+		t.Fatalf("unexpected route: wanted default, found %v", route)
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	var tests = []struct {
+		in string
+		ok bool
+	}{
+		{in: "domain example.com direct", ok: true},
+		{in: "port 443 direct", ok: true},
+		{in: "all direct", ok: true},
+		{in: "domain example.com", ok: false},
+		{in: "regex ( direct", ok: false},
+		{in: "glob [ direct", ok: false},
+		{in: "cidr 10.0.0.0 direct", ok: false},
+		{in: "port 90-80 direct", ok: false},
+		{in: "port 70000 direct", ok: false},
+		{in: "host example.com direct", ok: false},
+	}
+
+	for _, test := range tests {
+		if _, err := dialer.ParseRule(test.in); (err == nil) != test.ok {
+			t.Fatalf("%q: unexpected error: %v", test.in, err)
+		}
+	}
+}
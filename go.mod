@@ -1,7 +1,6 @@
 module github.com/booster-proj/proxy
 
 require (
-	golang.org/x/net v0.0.0-20180801234040-f4c29de78a2a // indirect
-	golang.org/x/sync v0.0.0-20180314180146-1d60e4601c6f
+	golang.org/x/net v0.0.0-20180801234040-f4c29de78a2a
 	upspin.io v0.0.0-20180816050821-c137ad0d6be9
 )
@@ -0,0 +1,78 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package http
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultRealm is the protection space sent to clients when
+// they are asked to authenticate.
+const DefaultRealm = "proxy"
+
+// authenticate validates the credentials stored in the
+// Proxy-Authorization field of r, returning the user they belong to.
+func (p *Proxy) authenticate(r *http.Request) (string, error) {
+	v := r.Header.Get("Proxy-Authorization")
+	if v == "" {
+		return "", errors.New("authenticate: missing credentials")
+	}
+
+	const prefix = "basic "
+	if len(v) < len(prefix) || !strings.EqualFold(v[:len(prefix)], prefix) {
+		return "", errors.New("authenticate: unsupported authentication scheme")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v[len(prefix):]))
+	if err != nil {
+		return "", errors.New("authenticate: malformed credentials: " + err.Error())
+	}
+
+	i := strings.IndexByte(string(b), ':')
+	if i < 0 {
+		return "", errors.New("authenticate: malformed credentials")
+	}
+	user, password := string(b[:i]), string(b[i+1:])
+
+	if err := p.Authenticator.Authenticate(user, password); err != nil {
+		return "", errors.New("authenticate: user " + user + ": " + err.Error())
+	}
+	return user, nil
+}
+
+// challenge asks the client to authenticate using the Basic scheme.
+func (p *Proxy) challenge(w http.ResponseWriter) {
+	realm := p.Realm
+	if realm == "" {
+		realm = DefaultRealm
+	}
+
+	w.Header().Set("Proxy-Authenticate", "Basic realm="+strconv.Quote(realm))
+	http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+}
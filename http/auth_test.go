@@ -0,0 +1,134 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package http_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/booster-proj/proxy/auth"
+	proxy_http "github.com/booster-proj/proxy/http"
+)
+
+func TestProxyAuthorization(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("Proxy-Authorization field was forwarded")
+		}
+		io.WriteString(w, "body")
+	}))
+	defer origin.Close()
+
+	var allowed string
+	p := proxy_http.New()
+	p.Authenticator = auth.Static{"user": "pass"}
+	p.Allow = func(r *http.Request) bool {
+		allowed, _ = auth.UserFromContext(r.Context())
+		return true
+	}
+
+	var tests = []struct {
+		user   *url.Userinfo
+		status int
+	}{
+		{user: nil, status: http.StatusProxyAuthRequired},
+		{user: url.UserPassword("user", "wrong"), status: http.StatusProxyAuthRequired},
+		{user: url.UserPassword("user", "pass"), status: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		allowed = ""
+
+		resp, err := proxyClient(t, p, test.user).Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Fatalf("unexpected status code. Wanted %d, found %d", test.status, resp.StatusCode)
+		}
+		if test.status != http.StatusProxyAuthRequired {
+			if allowed != "user" {
+				t.Fatalf("authenticated user was not exposed to the Allow hook, found %q", allowed)
+			}
+			continue
+		}
+
+		if s := resp.Header.Get("Proxy-Authenticate"); s != `Basic realm="proxy"` {
+			t.Fatalf("unexpected Proxy-Authenticate field: %q", s)
+		}
+	}
+}
+
+func TestProxyAuthorizationConnect(t *testing.T) {
+	p := proxy_http.New()
+	p.Authenticator = auth.Static{"user": "pass"}
+	p.Allow = func(r *http.Request) bool {
+		user, _ := auth.UserFromContext(r.Context())
+		return user == "user"
+	}
+
+	upstream := httptest.NewServer(p)
+	defer upstream.Close()
+	target := echo(t)
+
+	var tests = []struct {
+		user     string
+		password string
+		status   int
+	}{
+		{user: "user", password: "pass", status: http.StatusOK},
+		{user: "user", password: "wrong", status: http.StatusProxyAuthRequired},
+	}
+
+	for _, test := range tests {
+		c := proxy_http.NewClient(upstream.Listener.Addr().String())
+		c.Username = test.user
+		c.Password = test.password
+
+		conn, err := c.DialContext(context.Background(), "tcp", target)
+		if test.status == http.StatusOK {
+			if err != nil {
+				t.Fatal(err)
+			}
+			ping(t, conn)
+			conn.Close()
+			continue
+		}
+
+		serr, ok := err.(*proxy_http.StatusError)
+		if !ok {
+			t.Fatalf("expected a status error, found %v", err)
+		}
+		if serr.StatusCode != test.status {
+			t.Fatalf("unexpected status code. Wanted %d, found %d", test.status, serr.StatusCode)
+		}
+	}
+}
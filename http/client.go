@@ -0,0 +1,210 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package http
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/booster-proj/proxy/dialer"
+)
+
+// Client is a dialer that opens TCP tunnels through an upstream HTTP
+// proxy, using the CONNECT method.
+type Client struct {
+	// Addr is the address of the upstream proxy.
+	Addr string
+
+	// Username and Password are sent to the upstream proxy using the
+	// Basic authentication scheme, when Username is not empty.
+	Username string
+	Password string
+
+	// TLSConfig, if not nil, is used to establish a TLS session with
+	// the upstream proxy.
+	TLSConfig *tls.Config
+
+	// Forward is used to connect to the upstream proxy. If nil,
+	// dialer.Default is used.
+	Forward dialer.Dialer
+}
+
+// NewClient returns a new Client instance that connects through the
+// HTTP proxy listening on addr.
+func NewClient(addr string) *Client {
+	return &Client{
+		Addr:    addr,
+		Forward: dialer.Default,
+	}
+}
+
+// DialContext opens a tunnel to addr through the upstream proxy. Only TCP
+// networks are supported. If the proxy does not answer with a 2xx status
+// code, the error returned is a *StatusError.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.New("DialContext: unsupported network: " + network)
+	}
+
+	d := c.Forward
+	if d == nil {
+		d = dialer.Default
+	}
+	conn, err := d.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		// the failure concerns the upstream proxy, and must not
+		// be mistaken for one of the destination.
+		return nil, errors.New("DialContext: upstream proxy " + c.Addr + ": " + err.Error())
+	}
+
+	if c.TLSConfig != nil {
+		cfg := c.TLSConfig.Clone()
+		if cfg.ServerName == "" {
+			host, _, _ := net.SplitHostPort(c.Addr)
+			cfg.ServerName = host
+		}
+		conn = tls.Client(conn, cfg)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		conn, err := c.connect(conn, addr)
+		resc <- result{conn, err}
+	}()
+
+	select {
+	case res := <-resc:
+		if res.err != nil {
+			conn.Close()
+			return nil, res.err
+		}
+		return res.conn, nil
+	case <-ctx.Done():
+		conn.Close()
+		<-resc // wait for connect to return
+		return nil, ctx.Err()
+	}
+}
+
+// connect asks the upstream proxy, reachable through conn, to open a
+// tunnel to addr.
+func (c *Client) connect(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if c.Username != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, errors.New("connect: unable to write request: " + err.Error())
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, errors.New("connect: unable to read response: " + err.Error())
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	if br.Buffered() > 0 {
+		// the tunnel already delivered some data
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// StatusError is returned by Client when the upstream proxy refuses
+// to open a tunnel.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return "http: upstream proxy replied: " + e.Status
+}
+
+// Unwrap makes errors caused by a forbidden response match
+// dialer.ErrNotAllowed, and the ones caused by a gateway error, i.e. the
+// upstream proxy could not reach the destination, match
+// dialer.ErrUnreachable.
+func (e *StatusError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusForbidden:
+		return dialer.ErrNotAllowed
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return dialer.ErrUnreachable
+	default:
+		return nil
+	}
+}
+
+// bufferedConn is a net.Conn whose reads are served through r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Unwrap returns the connection wrapped by c, once the data buffered by
+// r has been consumed, nil before.
+func (c *bufferedConn) Unwrap() net.Conn {
+	if c.r.Buffered() > 0 {
+		return nil
+	}
+	return c.Conn
+}
+
+// CloseWrite closes the write side of the connection, if supported.
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("CloseWrite: not supported by " + c.Conn.LocalAddr().Network() + " connections")
+}
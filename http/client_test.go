@@ -0,0 +1,134 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package http_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	proxy_http "github.com/booster-proj/proxy/http"
+)
+
+// echo starts a TCP server that writes back what it reads,
+// returning its address.
+func echo(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// ping writes a message to conn and checks that it is echoed back.
+func ping(t *testing.T, conn net.Conn) {
+	msg := []byte("hello")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatalf("unexpected data. Wanted %q, found %q", msg, buf)
+	}
+}
+
+func TestClient(t *testing.T) {
+	upstream := httptest.NewServer(proxy_http.New())
+	defer upstream.Close()
+
+	c := proxy_http.NewClient(upstream.Listener.Addr().String())
+	conn, err := c.DialContext(context.Background(), "tcp", echo(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ping(t, conn)
+}
+
+func TestClientTLS(t *testing.T) {
+	upstream := httptest.NewTLSServer(proxy_http.New())
+	defer upstream.Close()
+
+	c := proxy_http.NewClient(upstream.Listener.Addr().String())
+	c.TLSConfig = upstream.Client().Transport.(*http.Transport).TLSClientConfig
+
+	conn, err := c.DialContext(context.Background(), "tcp", echo(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ping(t, conn)
+}
+
+func TestClientStatusError(t *testing.T) {
+	var auth string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Proxy-Authorization")
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer upstream.Close()
+
+	c := proxy_http.NewClient(upstream.Listener.Addr().String())
+	c.Username = "user"
+	c.Password = "pass"
+
+	_, err := c.DialContext(context.Background(), "tcp", "example.com:443")
+	serr, ok := err.(*proxy_http.StatusError)
+	if !ok {
+		t.Fatalf("expected a status error, found %v", err)
+	}
+	if serr.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("unexpected status code. Wanted %d, found %d", http.StatusProxyAuthRequired, serr.StatusCode)
+	}
+	if !strings.HasPrefix(auth, "Basic ") {
+		t.Fatalf("unexpected Proxy-Authorization header: %q", auth)
+	}
+}
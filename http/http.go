@@ -28,20 +28,30 @@ package http
 import (
 	"context"
 	"crypto/tls"
-	"fmt"
+	"errors"
 	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/textproto"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/booster-proj/proxy/auth"
 	"github.com/booster-proj/proxy/dialer"
 	"github.com/booster-proj/proxy/transmit"
 )
 
 var logger = log.New(os.Stdout, "", log.LstdFlags|log.Lshortfile)
 
+// DefaultIdleTimeout is the idle timeout of the CONNECT tunnels, used
+// by the proxies returned by New.
+const DefaultIdleTimeout = 30 * time.Second
+
 // Proxy represents a HTTP proxy server implementation.
 type Proxy struct {
 	dialer.Dialer
@@ -49,6 +59,42 @@ type Proxy struct {
 
 	S *http.Server
 	C *http.Client
+
+	// Authenticator, if not nil, is used to validate the credentials
+	// that clients provide using the Basic scheme in the
+	// Proxy-Authorization field. Requests without valid credentials
+	// are answered with 407 Proxy Authentication Required.
+	Authenticator auth.Authenticator
+	// Realm is sent to the clients that have to authenticate. If
+	// empty, DefaultRealm is used.
+	Realm string
+
+	// Interceptor, if not nil, is used to terminate the TLS sessions
+	// opened through CONNECT tunnels directed to the hosts it matches.
+	// The decrypted requests are served as plain HTTP requests, and
+	// re-encrypted towards their destination.
+	Interceptor *Interceptor
+
+	// Allow, if not nil, is called before serving each request.
+	// Requests not allowed are answered with 403 Forbidden. The
+	// authenticated user, if any, is available in the request
+	// context, see auth.UserFromContext.
+	Allow func(r *http.Request) bool
+
+	// OnSession, if not nil, is called each time a tunnel opened with
+	// a CONNECT request is closed. It is called synchronously, before
+	// the client connection is closed.
+	OnSession func(transmit.Session)
+
+	// Relay copies the data of the tunnels opened with CONNECT
+	// requests. Its timeouts, buffers and throttling can be
+	// configured.
+	Relay transmit.Relay
+
+	// handoff feeds the connections passed to ServeConn to the
+	// server loop started by the first call.
+	handoffOnce sync.Once
+	handoff     *chanListener
 }
 
 // New returns a new Proxy instance that serves HTTP connections.
@@ -63,7 +109,19 @@ func New() *Proxy {
 		TLSNextProto:   make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
 	}
 	p.C = &http.Client{Transport: makeTransport(nil)}
+	p.Relay = transmit.Relay{
+		IdleTimeout: DefaultIdleTimeout,
+		BufferSize:  int(transmit.DTU),
+	}
+
+	return p
+}
 
+// NewTLS returns a new Proxy instance that serves its clients over TLS,
+// using config. CONNECT tunnels are opened inside the TLS session.
+func NewTLS(config *tls.Config) *Proxy {
+	p := New()
+	p.S.TLSConfig = config
 	return p
 }
 
@@ -88,13 +146,29 @@ func (p *Proxy) DialWith(d dialer.Dialer) {
 	}
 }
 
-// ListenAndServe reveals the proxy to the network. If p is storing a complete tls
-// configuration, p will serve HTTPS connections.
-func (p *Proxy) ListenAndServe(ctx context.Context, port int) error {
-	c := make(chan error)
+// ListenAndServe listens on the TCP network address addr and then calls
+// Serve to handle the incoming connections.
+func (p *Proxy) ListenAndServe(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return p.Serve(ctx, ln)
+}
+
+// Serve accepts the connections on ln and serves their requests. If p is
+// storing a complete tls configuration, p will serve HTTPS connections.
+// Serve closes ln when returning, which happens when ln fails or ctx is
+// canceled.
+func (p *Proxy) Serve(ctx context.Context, ln net.Listener) error {
+	c := make(chan error, 1)
 	go func() {
-		p.S.Addr = fmt.Sprintf(":%d", port)
-		c <- p.S.ListenAndServe()
+		if p.S.TLSConfig != nil {
+			// certificates are provided by the configuration
+			c <- p.S.ServeTLS(ln, "", "")
+			return
+		}
+		c <- p.S.Serve(ln)
 	}()
 
 	select {
@@ -107,14 +181,70 @@ func (p *Proxy) ListenAndServe(ctx context.Context, port int) error {
 	}
 }
 
+// ServeConn serves the requests read from conn, a connection that was
+// accepted by another listener. If the receiver is configured for TLS, the
+// handshake is performed on conn first. ServeConn does not wait for conn to
+// be closed.
+//
+// The connections passed to ServeConn are served by a single server loop,
+// started by the first call, which ends when S is shut down. Afterwards
+// conn is closed and ErrServerClosed is returned.
+func (p *Proxy) ServeConn(conn net.Conn) error {
+	p.handoffOnce.Do(func() {
+		p.handoff = newChanListener(conn.LocalAddr())
+		go func() {
+			var err error
+			if p.S.TLSConfig != nil {
+				err = p.S.ServeTLS(p.handoff, "", "")
+			} else {
+				err = p.S.Serve(p.handoff)
+			}
+			if err != http.ErrServerClosed {
+				logger.Println(err)
+			}
+			p.handoff.Close()
+		}()
+	})
+
+	if err := p.handoff.push(conn); err != nil {
+		conn.Close()
+		return http.ErrServerClosed
+	}
+	return nil
+}
+
 func (p *Proxy) Protocol() string {
+	if p.S.TLSConfig != nil {
+		return "https"
+	}
 	return "http"
 }
 
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.Authenticator != nil {
+		user, err := p.authenticate(r)
+		if err != nil {
+			logger.Printf("%v %v: %v", r.Method, r.Host, err)
+			p.challenge(w)
+			return
+		}
+		r = r.WithContext(auth.NewContext(r.Context(), user))
+	}
+	// credentials are not forwarded, and must not be logged.
+	r.Header.Del("Proxy-Authorization")
+
 	dumpReq, err := httputil.DumpRequest(r, false)
 	if err == nil {
-		log.Printf("%s", dumpReq)
+		if user, ok := auth.UserFromContext(r.Context()); ok {
+			log.Printf("user(%s) %s", user, dumpReq)
+		} else {
+			log.Printf("%s", dumpReq)
+		}
+	}
+
+	if p.Allow != nil && !p.Allow(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
 	}
 
 	if r.Method == http.MethodConnect {
@@ -125,32 +255,134 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (p *Proxy) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	outr := r.Clone(r.Context())
+	outr.RequestURI = "" // not allowed in client requests
+
 	// Cleanup header fields to relvant to the upstream
-	CleanHeader(&r.Header)
+	CleanHeader(&outr.Header)
+	if acceptsTrailers(r.Header) {
+		// Te is hop-by-hop, but the client is announcing
+		// a capability that concerns the whole chain.
+		outr.Header.Set("Te", "trailers")
+	}
 
-	resp, err := p.C.Transport.RoundTrip(r)
+	resp, err := p.C.Transport.RoundTrip(outr)
 	if err != nil {
 		logger.Println(err)
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		dialError(w, err)
 		return
 	}
 
 	defer resp.Body.Close()
 
-	w.WriteHeader(http.StatusOK)
-	io.Copy(w, resp.Body)
-}
+	// Cleanup header fields not relevant to the downstream
+	CleanHeader(&resp.Header)
+	CopyHeader(w.Header(), resp.Header)
+
+	// announce the trailers that will follow the body
+	if len(resp.Trailer) > 0 {
+		keys := make([]string, 0, len(resp.Trailer))
+		for k := range resp.Trailer {
+			keys = append(keys, k)
+		}
+		w.Header().Set("Trailer", strings.Join(keys, ", "))
+	}
 
-func (p *Proxy) handleConnect(w http.ResponseWriter, r *http.Request) {
-	// create remote connection
-	dst_conn, err := p.DialContext(context.Background(), "tcp", r.Host)
-	if err != nil {
+	w.WriteHeader(resp.StatusCode)
+
+	// streaming responses have to reach the client as soon as
+	// possible.
+	flush := resp.ContentLength == -1 || isEventStream(resp.Header)
+	if err := copyBody(w, resp.Body, flush, p.writeTimeout()); err != nil {
 		logger.Println(err)
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	// trailers are available only after the body has been read
+	for k, v := range resp.Trailer {
+		w.Header()[k] = v
+	}
+}
+
+// copyBody copies body into w. If flush is true and w supports it,
+// data is flushed to the client as soon as it is written. As streamed
+// responses can last indefinitely, the write deadline of the server is
+// then applied to each write, instead of the whole response: timeout is
+// the duration each write is allowed, zero meaning no limit.
+func copyBody(w http.ResponseWriter, body io.Reader, flush bool, timeout time.Duration) error {
+	f, ok := w.(http.Flusher)
+	if !flush || !ok {
+		_, err := io.Copy(w, body)
+		return err
+	}
+
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			var deadline time.Time
+			if timeout > 0 {
+				deadline = time.Now().Add(timeout)
+			}
+			rc.SetWriteDeadline(deadline) // not supported by every writer
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			f.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeTimeout returns the write timeout of the server, if any.
+func (p *Proxy) writeTimeout() time.Duration {
+	if p.S == nil {
+		return 0
+	}
+	return p.S.WriteTimeout
+}
+
+// dialError replies to the client with the error that prevented the
+// request from reaching its destination. Connections refused by the
+// policy of the dialer are forbidden.
+func dialError(w http.ResponseWriter, err error) {
+	if errors.Is(err, dialer.ErrNotAllowed) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+}
+
+func isEventStream(h http.Header) bool {
+	t, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return t == "text/event-stream"
+}
+
+func (p *Proxy) handleConnect(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	intercept := p.Interceptor != nil && p.Interceptor.Match(host)
+
+	// create remote connection, intercepted sessions are
+	// forwarded using the transport instead.
+	var dst_conn net.Conn
+	if !intercept {
+		dst_conn, err = p.DialContext(r.Context(), "tcp", r.Host)
+		if err != nil {
+			logger.Println(err)
+			dialError(w, err)
+			return
+		}
+		defer dst_conn.Close()
+	}
 
 	// take over source connection
 	hijacker, ok := w.(http.Hijacker)
@@ -161,30 +393,106 @@ func (p *Proxy) handleConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	src_conn, _, err := hijacker.Hijack()
+	src_conn, rw, err := hijacker.Hijack()
 	if err != nil {
 		logger.Println(err)
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
+	defer src_conn.Close()
+
+	// the connection is no longer managed by the server, remove
+	// the deadlines it might have set.
+	src_conn.SetDeadline(time.Time{})
+
+	// the response has to be written directly on the connection,
+	// as the one buffered by the server is lost after hijacking it.
+	if _, err := io.WriteString(src_conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		logger.Println(err)
+		return
+	}
+	if rw.Reader.Buffered() > 0 {
+		// the client already sent some data through the tunnel
+		src_conn = &bufferedConn{Conn: src_conn, r: rw.Reader}
+	}
+
+	if intercept {
+		p.intercept(r.Context(), src_conn, r.Host)
+		return
+	}
+
+	sess := transmit.Session{
+		Protocol: p.Protocol(),
+		Source:   r.RemoteAddr,
+		Target:   r.Host,
+		Start:    time.Now(),
+	}
+	sess.User, _ = auth.UserFromContext(r.Context())
 
 	// copy data from src_ to dst_conn and vice versa
-	ctx := transmit.NewContext(context.Background(), time.Second*30, 1500)
-	transmit.Data(ctx, dst_conn, src_conn)
+	ctx := context.Background()
+	if sess.User != "" {
+		ctx = auth.NewContext(ctx, sess.User)
+	}
+	sess.Stats, err = p.Relay.Data(ctx, src_conn, dst_conn)
+	if err != nil {
+		logger.Printf("CONNECT %v: %v", r.Host, err)
+	}
+
+	logger.Printf("CONNECT %v closed: d(%v) sent(%d) recv(%d) reason(%v)", r.Host, sess.Duration, sess.BytesSent, sess.BytesReceived, sess.Reason)
+	if p.OnSession != nil {
+		p.OnSession(sess)
+	}
 }
 
+// CopyHeader copies the fields of src into dst.
 func CopyHeader(dst, src http.Header) {
 	for k, v := range src {
 		dst[k] = v
 	}
 }
 
+// hopHeaders are the header fields that are meaningful only for a single
+// transport-level connection, and are not forwarded by proxies.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard, sent by some clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
 // CleanHeader cleans the header from the fields that are not intended to
-// be relevant to downstream recipients. See RFC 7230 section 6.1.
+// be relevant to downstream recipients, i.e. the hop-by-hop fields and the
+// ones listed in the Connection field. See RFC 7230 section 6.1.
 func CleanHeader(h *http.Header) {
-	k := http.CanonicalHeaderKey("Connection")
-	v := h.Get(k)
+	// delete the fields referenced by the Connection fields
+	for _, v := range (*h)["Connection"] {
+		for _, f := range strings.Split(v, ",") {
+			if f = textproto.TrimString(f); f != "" {
+				h.Del(f)
+			}
+		}
+	}
 
-	h.Del(v) // delete the field referenced by the Connection field
-	h.Del(k) // delete the Connection field itself
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// acceptsTrailers reports whether the client is willing to
+// accept trailer fields in a chunked transfer coding.
+func acceptsTrailers(h http.Header) bool {
+	for _, v := range h["Te"] {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(textproto.TrimString(f), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
 }
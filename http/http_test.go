@@ -25,10 +25,30 @@ SOFTWARE.
 package http_test
 
 import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/booster-proj/proxy/dialer"
 	proxy_http "github.com/booster-proj/proxy/http"
+	"github.com/booster-proj/proxy/transmit"
 )
 
 func TestCleanHeader(t *testing.T) {
@@ -48,3 +68,436 @@ func TestCleanHeader(t *testing.T) {
 		t.Fatalf("field %v should be empty, found %v instead", fooK, s)
 	}
 }
+
+func TestCleanHeaderHopByHop(t *testing.T) {
+	var tests = []struct {
+		in      http.Header
+		deleted []string
+		kept    []string
+	}{
+		{in: http.Header{
+			"Connection": {"Foo, Bar"},
+			"Foo":        {"1"},
+			"Bar":        {"2"},
+			"Baz":        {"3"},
+		},
+			deleted: []string{"Connection", "Foo", "Bar"},
+			kept:    []string{"Baz"}}, // comma separated list
+
+		{in: http.Header{
+			"Connection": {"foo", " bar ,,"},
+			"Foo":        {"1"},
+			"Bar":        {"2"},
+		},
+			deleted: []string{"Connection", "Foo", "Bar"}}, // multiple fields, case insensitive
+
+		{in: http.Header{
+			"Proxy-Connection":    {"keep-alive"},
+			"Keep-Alive":          {"timeout=5"},
+			"Proxy-Authenticate":  {"Basic"},
+			"Proxy-Authorization": {"Basic dXNlcjpwYXNz"},
+			"Te":                  {"trailers"},
+			"Trailer":             {"X-Checksum"},
+			"Transfer-Encoding":   {"chunked"},
+			"Upgrade":             {"websocket"},
+			"Content-Type":        {"text/plain"},
+			"Authorization":       {"Bearer token"},
+		},
+			deleted: []string{"Proxy-Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+				"Te", "Trailer", "Transfer-Encoding", "Upgrade"},
+			kept: []string{"Content-Type", "Authorization"}}, // standard hop-by-hop fields
+
+		{in: http.Header{
+			"Connection": {"close"},
+			"Close":      {"not really a field"},
+		},
+			deleted: []string{"Connection", "Close"}}, // connection option
+	}
+
+	for i, test := range tests {
+		proxy_http.CleanHeader(&test.in)
+
+		for _, k := range test.deleted {
+			if _, ok := test.in[k]; ok {
+				t.Fatalf("%d: field %v should have been deleted", i, k)
+			}
+		}
+		for _, k := range test.kept {
+			if _, ok := test.in[k]; !ok {
+				t.Fatalf("%d: field %v should have been kept", i, k)
+			}
+		}
+	}
+}
+
+// clientCert returns a pool containing a new CA, together with a client
+// certificate signed by it.
+func clientCert(t *testing.T) (*x509.CertPool, tls.Certificate) {
+	certPEM, keyPEM, err := proxy_http.GenerateCA("test client CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	return pool, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestNewTLS(t *testing.T) {
+	// borrow the certificate of a test server
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	roots := ts.Client().Transport.(*http.Transport).TLSClientConfig
+	clientCAs, cert := clientCert(t)
+	target := echo(t)
+
+	var tests = []struct {
+		clientAuth tls.ClientAuthType
+		cert       bool // the client presents a certificate
+		err        bool
+	}{
+		{clientAuth: tls.NoClientCert, err: false},
+		{clientAuth: tls.RequireAndVerifyClientCert, err: true}, // client has no certificate
+		{clientAuth: tls.RequireAndVerifyClientCert, cert: true, err: false},
+	}
+
+	for _, test := range tests {
+		p := proxy_http.NewTLS(&tls.Config{
+			Certificates: ts.TLS.Certificates,
+			ClientAuth:   test.clientAuth,
+			ClientCAs:    clientCAs,
+		})
+		if proto := p.Protocol(); proto != "https" {
+			t.Fatalf("unexpected protocol: %v", proto)
+		}
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go p.S.ServeTLS(ln, "", "")
+		defer p.S.Close()
+
+		c := proxy_http.NewClient(ln.Addr().String())
+		c.TLSConfig = roots.Clone()
+		if test.cert {
+			c.TLSConfig.Certificates = []tls.Certificate{cert}
+		}
+
+		conn, err := c.DialContext(context.Background(), "tcp", target)
+		if err != nil {
+			if !test.err {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if test.err {
+			t.Fatal("expected client certificate verification error")
+		}
+
+		ping(t, conn)
+		conn.Close()
+	}
+}
+
+// proxyClient returns an HTTP client that sends its requests
+// through p, without following redirects. If user is not nil, it is
+// used to authenticate with the proxy.
+func proxyClient(t *testing.T, p http.Handler, user *url.Userinfo) *http.Client {
+	ps := httptest.NewServer(p)
+	t.Cleanup(ps.Close)
+
+	u, err := url.Parse(ps.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.User = user
+
+	return &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(u)},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func TestHandleHTTP(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// report the request hop-by-hop field, if it was forwarded
+		w.Header().Set("X-Seen-Hop", r.Header.Get("X-Hop"))
+		w.Header().Set("X-Seen-Te", r.Header.Get("Te"))
+
+		switch r.URL.Path {
+		case "/notfound":
+			w.Header().Set("X-Origin", "yes")
+			http.NotFound(w, r)
+		case "/redirect":
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		case "/trailer":
+			w.Header().Set("Trailer", "X-Checksum")
+			io.WriteString(w, "body")
+			w.Header().Set("X-Checksum", "abc")
+		case "/hop":
+			w.Header().Set("Connection", "X-Hop")
+			w.Header().Set("X-Hop", "1")
+			io.WriteString(w, "body")
+		default:
+			io.WriteString(w, "body")
+		}
+	}))
+	defer origin.Close()
+
+	c := proxyClient(t, proxy_http.New(), nil)
+
+	var tests = []struct {
+		path    string
+		status  int
+		header  map[string]string
+		trailer map[string]string
+	}{
+		{path: "/", status: http.StatusOK, header: map[string]string{"X-Seen-Te": "trailers"}},
+		{path: "/notfound", status: http.StatusNotFound, header: map[string]string{"X-Origin": "yes"}},
+		{path: "/redirect", status: http.StatusFound, header: map[string]string{"Location": "/elsewhere"}},
+		{path: "/trailer", status: http.StatusOK, trailer: map[string]string{"X-Checksum": "abc"}},
+		{path: "/hop", status: http.StatusOK, header: map[string]string{"X-Hop": "", "X-Seen-Hop": ""}},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, origin.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "1")
+		req.Header.Set("Te", "deflate, trailers")
+
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Fatalf("%v: unexpected status code. Wanted %d, found %d", test.path, test.status, resp.StatusCode)
+		}
+		for k, v := range test.header {
+			if s := resp.Header.Get(k); s != v {
+				t.Fatalf("%v: unexpected %v header. Wanted %q, found %q", test.path, k, v, s)
+			}
+		}
+		for k, v := range test.trailer {
+			if s := resp.Trailer.Get(k); s != v {
+				t.Fatalf("%v: unexpected %v trailer. Wanted %q, found %q", test.path, k, v, s)
+			}
+		}
+	}
+}
+
+func TestHandleHTTPStreaming(t *testing.T) {
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer origin.Close()
+	defer close(release)
+
+	resp, err := proxyClient(t, proxy_http.New(), nil).Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// the origin is still writing the response, the first event
+	// has to be available anyway.
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "data: first\n" {
+		t.Fatalf("unexpected event: %q", line)
+	}
+}
+
+func TestHandleHTTPStreamingTimeout(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 5; i++ {
+			io.WriteString(w, "data: tick\n\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer origin.Close()
+
+	// the response lasts longer than the write timeout of the server.
+	p := proxy_http.New()
+	p.S.WriteTimeout = 200 * time.Millisecond
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Serve(ctx, ln)
+
+	u := &url.URL{Scheme: "http", Host: ln.Addr().String()}
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+	resp, err := c.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "data: tick"); n != 5 {
+		t.Fatalf("unexpected number of events: wanted 5, found %d", n)
+	}
+}
+
+func TestServe(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "body")
+	}))
+	defer origin.Close()
+
+	path := filepath.Join(t.TempDir(), "http.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- proxy_http.New().Serve(ctx, ln) }()
+
+	c := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: "proxy"}),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	resp, err := c.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "body" {
+		t.Fatalf("unexpected body: %q", b)
+	}
+
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("unexpected error: wanted %v, found %v", context.Canceled, err)
+	}
+}
+
+func TestConnectSession(t *testing.T) {
+	sessions := make(chan transmit.Session, 1)
+	p := proxy_http.New()
+	p.OnSession = func(sess transmit.Session) { sessions <- sess }
+
+	upstream := httptest.NewServer(p)
+	defer upstream.Close()
+	target := echo(t)
+
+	c := proxy_http.NewClient(upstream.Listener.Addr().String())
+	conn, err := c.DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping(t, conn)
+	conn.Close()
+
+	sess := <-sessions
+	if sess.Protocol != "http" || sess.Target != target || sess.Source != conn.LocalAddr().String() {
+		t.Fatalf("unexpected session: %+v", sess)
+	}
+	if sess.BytesSent != 5 || sess.BytesReceived != 5 {
+		t.Fatalf("unexpected byte count: wanted (5, 5), found (%d, %d)", sess.BytesSent, sess.BytesReceived)
+	}
+	if sess.Reason != transmit.ReasonEOF {
+		t.Fatalf("unexpected reason: wanted %v, found %v", transmit.ReasonEOF, sess.Reason)
+	}
+}
+
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+func TestDialError(t *testing.T) {
+	var tests = []struct {
+		err    error
+		status int
+	}{
+		{err: dialer.ErrNotAllowed, status: http.StatusForbidden},
+		{err: errors.New("dial failed"), status: http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		p := proxy_http.New()
+		p.DialWith(dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, test.err
+		}))
+
+		resp, err := proxyClient(t, p, nil).Get("http://example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Fatalf("%v: unexpected status code. Wanted %d, found %d", test.err, test.status, resp.StatusCode)
+		}
+		if test.status == http.StatusForbidden && strings.Contains(string(body), test.err.Error()) {
+			t.Fatalf("%v: error reported to the client: %q", test.err, body)
+		}
+
+		upstream := httptest.NewServer(p)
+		c := proxy_http.NewClient(upstream.Listener.Addr().String())
+		_, err = c.DialContext(context.Background(), "tcp", "example.com:443")
+		upstream.Close()
+		serr, ok := err.(*proxy_http.StatusError)
+		if !ok {
+			t.Fatalf("%v: expected a status error, found %v", test.err, err)
+		}
+		if serr.StatusCode != test.status {
+			t.Fatalf("%v: unexpected CONNECT status code. Wanted %d, found %d", test.err, test.status, serr.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package http
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// errListenerClosed is returned by a connListener that
+// has no more connections to offer.
+var errListenerClosed = errors.New("http: listener closed")
+
+// connListener is a net.Listener that returns a single connection, even
+// if closed before. After that, calls to Accept block until the listener is
+// closed. It allows an http.Server to serve connections that were not
+// accepted by the server itself.
+type connListener struct {
+	conn net.Conn
+	c    chan net.Conn
+
+	once sync.Once
+	done chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{
+		conn: conn,
+		c:    make(chan net.Conn, 1),
+		done: make(chan struct{}),
+	}
+	l.c <- conn
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.c:
+		return conn, nil
+	default:
+	}
+
+	<-l.done
+	return nil, errListenerClosed
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// chanListener is a net.Listener that returns the connections pushed
+// into it, allowing an http.Server to serve connections accepted by
+// another listener.
+type chanListener struct {
+	addr net.Addr
+	c    chan net.Conn
+
+	once sync.Once
+	done chan struct{}
+}
+
+func newChanListener(addr net.Addr) *chanListener {
+	return &chanListener{
+		addr: addr,
+		c:    make(chan net.Conn),
+		done: make(chan struct{}),
+	}
+}
+
+// push hands conn to the next call to Accept, failing if the
+// listener is closed first.
+func (l *chanListener) push(conn net.Conn) error {
+	select {
+	case l.c <- conn:
+		return nil
+	case <-l.done:
+		return errListenerClosed
+	}
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.c:
+		return conn, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *chanListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *chanListener) Addr() net.Addr {
+	return l.addr
+}
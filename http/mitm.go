@@ -0,0 +1,310 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package http
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/booster-proj/proxy/auth"
+)
+
+// certValidity is the validity period of the certificates minted
+// by an Interceptor.
+const certValidity = 7 * 24 * time.Hour
+
+// maxCachedCerts is the maximum number of certificates cached by an
+// Interceptor. Server names are chosen by the clients, so the cache
+// has to be bounded.
+const maxCachedCerts = 1024
+
+// Interceptor mints certificates signed by a local certificate authority,
+// allowing the proxy to terminate the TLS sessions that clients open
+// through CONNECT tunnels. Clients must trust the authority for the
+// interception to be transparent.
+type Interceptor struct {
+	// Hosts lists the hosts whose sessions are intercepted. Entries
+	// starting with a dot match every subdomain of the entry, "*"
+	// matches every host.
+	Hosts []string
+
+	ca    *x509.Certificate
+	caKey crypto.Signer
+	key   crypto.Signer // shared by every certificate minted
+
+	sync.Mutex
+	cache map[string]*tls.Certificate // server name -> certificate
+}
+
+// NewInterceptor returns a new Interceptor instance that mints
+// certificates signed by ca, intercepting the sessions directed to
+// the hosts provided.
+func NewInterceptor(ca tls.Certificate, hosts ...string) (*Interceptor, error) {
+	if len(ca.Certificate) == 0 {
+		return nil, errors.New("NewInterceptor: missing CA certificate")
+	}
+	cert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, errors.New("NewInterceptor: " + err.Error())
+	}
+	if !cert.IsCA {
+		return nil, errors.New("NewInterceptor: certificate is not a CA")
+	}
+	caKey, ok := ca.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("NewInterceptor: unsupported CA private key")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.New("NewInterceptor: " + err.Error())
+	}
+
+	return &Interceptor{
+		Hosts: hosts,
+		ca:    cert,
+		caKey: caKey,
+		key:   key,
+		cache: make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// Match reports whether the sessions directed to host
+// should be intercepted.
+func (i *Interceptor) Match(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, h := range i.Hosts {
+		h = strings.ToLower(h)
+		switch {
+		case h == "*":
+			return true
+		case strings.HasPrefix(h, "."):
+			if host == h[1:] || strings.HasSuffix(host, h) {
+				return true
+			}
+		case host == h:
+			return true
+		}
+	}
+	return false
+}
+
+// Certificate returns a certificate valid for name, which is either a
+// host name or an IP address. Certificates are cached by name.
+func (i *Interceptor) Certificate(name string) (*tls.Certificate, error) {
+	name = strings.ToLower(name)
+
+	i.Lock()
+	c, ok := i.cache[name]
+	i.Unlock()
+	if ok && time.Now().Add(time.Hour).Before(c.Leaf.NotAfter) {
+		return c, nil
+	}
+
+	c, err := i.mint(name)
+	if err != nil {
+		return nil, err
+	}
+
+	i.Lock()
+	defer i.Unlock()
+	if _, ok := i.cache[name]; !ok && len(i.cache) >= maxCachedCerts {
+		// evict a random entry.
+		for k := range i.cache {
+			delete(i.cache, k)
+			break
+		}
+	}
+	i.cache[name] = c
+	return c, nil
+}
+
+func (i *Interceptor) mint(name string) (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.New("mint: " + err.Error())
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{name}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, i.ca, i.key.Public(), i.caKey)
+	if err != nil {
+		return nil, errors.New("mint: " + err.Error())
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.New("mint: " + err.Error())
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, i.ca.Raw},
+		PrivateKey:  i.key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// GenerateCA creates a new self-signed certificate authority, valid for
+// the provided duration, that can be used by an Interceptor. Certificate
+// and private key are returned PEM encoded.
+func GenerateCA(name string, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.New("GenerateCA: " + err.Error())
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, errors.New("GenerateCA: " + err.Error())
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name, Organization: []string{name}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, errors.New("GenerateCA: " + err.Error())
+	}
+	kder, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, errors.New("GenerateCA: " + err.Error())
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: kder})
+	return certPEM, keyPEM, nil
+}
+
+// intercept terminates the TLS session that the client opens through
+// conn, a CONNECT tunnel directed to target, and serves the decrypted
+// requests as if they were sent to the proxy. Returns when conn is
+// closed.
+func (p *Proxy) intercept(ctx context.Context, conn net.Conn, target string) {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+
+	tconn := tls.Server(conn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = host
+			}
+			return p.Interceptor.Certificate(name)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+
+	// requests are served in a context that carries only the values
+	// of the one that opened the tunnel.
+	base := context.Background()
+	if user, ok := auth.UserFromContext(ctx); ok {
+		base = auth.NewContext(base, user)
+	}
+
+	l := newConnListener(tconn)
+	s := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// requests are forwarded only to the target of the
+			// tunnel, whatever their Host field says.
+			if r.Host != "" && !sameHost(r.Host, target) {
+				http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+				return
+			}
+			r.URL.Scheme = "https"
+			r.URL.Host = target
+
+			if p.Allow != nil && !p.Allow(r) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			p.handleHTTP(w, r)
+		}),
+		BaseContext:    func(net.Listener) context.Context { return base },
+		ReadTimeout:    p.S.ReadTimeout,
+		WriteTimeout:   p.S.WriteTimeout,
+		MaxHeaderBytes: p.S.MaxHeaderBytes,
+		TLSNextProto:   make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		ErrorLog:       logger,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				l.Close()
+			}
+		},
+	}
+	s.Serve(l)
+}
+
+// sameHost reports whether the Host field host designates target, a
+// host and port pair. A missing port in host stands for 443.
+func sameHost(host, target string) bool {
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		h, port = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), "443"
+	}
+	th, tport, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	norm := func(s string) string {
+		return strings.ToLower(strings.TrimSuffix(s, "."))
+	}
+	return norm(h) == norm(th) && port == tport
+}
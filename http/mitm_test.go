@@ -0,0 +1,196 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package http_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	proxy_http "github.com/booster-proj/proxy/http"
+)
+
+func TestInterceptorMatch(t *testing.T) {
+	i := &proxy_http.Interceptor{Hosts: []string{"example.com", ".example.org"}}
+
+	var tests = []struct {
+		host  string
+		match bool
+	}{
+		{host: "example.com", match: true},
+		{host: "EXAMPLE.com.", match: true},
+		{host: "www.example.com", match: false},
+		{host: "example.org", match: true},
+		{host: "www.example.org", match: true},
+		{host: "badexample.org", match: false},
+		{host: "example.net", match: false},
+	}
+
+	for _, test := range tests {
+		if m := i.Match(test.host); m != test.match {
+			t.Fatalf("%v: unexpected match result. Wanted %v, found %v", test.host, test.match, m)
+		}
+	}
+}
+
+func TestIntercept(t *testing.T) {
+	certPEM, keyPEM, err := proxy_http.GenerateCA("test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer origin.Close()
+
+	// the client trusts both the origin and the local CA.
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	roots.AddCert(origin.Certificate())
+
+	var tests = []struct {
+		hosts       []string
+		intercepted bool
+	}{
+		{hosts: []string{"127.0.0.1"}, intercepted: true},
+		{hosts: []string{"example.com"}, intercepted: false},
+	}
+
+	for _, test := range tests {
+		i, err := proxy_http.NewInterceptor(ca, test.hosts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := proxy_http.New()
+		p.Interceptor = i
+		p.C.Transport = origin.Client().Transport // trusts the origin
+
+		ps := httptest.NewServer(p)
+		defer ps.Close()
+		u, _ := url.Parse(ps.URL)
+
+		c := &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyURL(u),
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}}
+
+		resp, err := c.Get(origin.URL + "/path")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(b) != "/path" {
+			t.Fatalf("unexpected body: %q", b)
+		}
+
+		issuer := resp.TLS.PeerCertificates[0].Issuer.CommonName
+		if intercepted := issuer == "test CA"; intercepted != test.intercepted {
+			t.Fatalf("%v: unexpected interception. Wanted %v, issuer %q", test.hosts, test.intercepted, issuer)
+		}
+	}
+}
+
+func TestInterceptPolicy(t *testing.T) {
+	certPEM, keyPEM, err := proxy_http.GenerateCA("test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer origin.Close()
+
+	i, err := proxy_http.NewInterceptor(ca, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := proxy_http.New()
+	p.Interceptor = i
+	p.C.Transport = origin.Client().Transport
+	p.Allow = func(r *http.Request) bool {
+		return r.URL.Path != "/denied"
+	}
+
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+	u, _ := url.Parse(ps.URL)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	c := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(u),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+
+	var tests = []struct {
+		path   string
+		host   string // Host field, if not empty
+		status int
+	}{
+		{path: "/path", status: http.StatusOK},
+		{path: "/denied", status: http.StatusForbidden},
+		{path: "/path", host: "example.com", status: http.StatusMisdirectedRequest},
+		{path: "/path", host: "127.0.0.1:1", status: http.StatusMisdirectedRequest},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", origin.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.host != "" {
+			req.Host = test.host
+		}
+
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Fatalf("%v (host %q): unexpected status. Wanted %d, found %d", test.path, test.host, test.status, resp.StatusCode)
+		}
+	}
+}
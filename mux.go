@@ -0,0 +1,208 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/booster-proj/proxy/dialer"
+	"github.com/booster-proj/proxy/http"
+	"github.com/booster-proj/proxy/socks4"
+	"github.com/booster-proj/proxy/socks5"
+	"upspin.io/log"
+)
+
+// PeekTimeout is the maximum duration Mux waits for the first byte
+// sent by a client.
+const PeekTimeout = 10 * time.Second
+
+// Mux is a Proxy that serves several protocols on the same port,
+// detecting the one spoken by each client from the first byte it sends.
+// Nil fields disable the corresponding protocol.
+type Mux struct {
+	HTTP   *http.Proxy
+	HTTPS  *http.Proxy // serves clients that start with a TLS handshake
+	SOCKS5 *socks5.Proxy
+	SOCKS4 *socks4.Proxy
+}
+
+// NewMux returns a new Mux instance that serves HTTP, SOCKS5 and SOCKS4
+// clients. HTTPS is disabled, as it requires a TLS configuration.
+func NewMux() *Mux {
+	return &Mux{
+		HTTP:   http.New(),
+		SOCKS5: socks5.New(),
+		SOCKS4: socks4.New(),
+	}
+}
+
+func (m *Mux) Protocol() string {
+	return "auto"
+}
+
+// DialWith makes every proxy of the receiver dial new connections
+// using d, if d != nil.
+func (m *Mux) DialWith(d dialer.Dialer) {
+	if m.HTTP != nil {
+		m.HTTP.DialWith(d)
+	}
+	if m.HTTPS != nil {
+		m.HTTPS.DialWith(d)
+	}
+	if m.SOCKS5 != nil {
+		m.SOCKS5.DialWith(d)
+	}
+	if m.SOCKS4 != nil {
+		m.SOCKS4.DialWith(d)
+	}
+}
+
+// ListenAndServe listens on the TCP network address addr and then calls
+// Serve to handle the incoming connections.
+func (m *Mux) ListenAndServe(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return m.Serve(ctx, ln)
+}
+
+// Serve accepts the connections on ln, dispatching each of them to the
+// proxy that speaks its protocol. When ctx is canceled, the servers of
+// the HTTP proxies are shut down too.
+// Serve closes ln when returning, which happens when ln fails or ctx
+// is canceled.
+func (m *Mux) Serve(ctx context.Context, ln net.Listener) error {
+	defer ln.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				errc <- fmt.Errorf("Serve: cannot accept conn: %v", err)
+				return
+			}
+
+			go func() {
+				if err := m.Handle(ctx, conn); err != nil {
+					log.Error.Println(err)
+				}
+			}()
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		ln.Close()
+		<-errc // wait for listener to return
+		m.shutdownHTTP()
+		return ctx.Err()
+	}
+}
+
+// shutdownHTTP shuts down the servers of the HTTP proxies, closing the
+// connections handed to them. Active requests are given
+// socks5.DefaultGracePeriod to complete.
+func (m *Mux) shutdownHTTP() {
+	ctx, cancel := context.WithTimeout(context.Background(), socks5.DefaultGracePeriod)
+	defer cancel()
+
+	for _, p := range []*http.Proxy{m.HTTP, m.HTTPS} {
+		if p == nil {
+			continue
+		}
+		if err := p.S.Shutdown(ctx); err != nil {
+			p.S.Close()
+		}
+	}
+}
+
+// Handle peeks at the first byte sent through conn and hands the
+// connection to the proxy that speaks the protocol detected.
+func (m *Mux) Handle(ctx context.Context, conn net.Conn) error {
+	br := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(PeekTimeout))
+	b, err := br.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return errors.New("Handle: unable to detect protocol: " + err.Error())
+	}
+
+	// the peeked byte is still buffered.
+	pconn := &peekedConn{Conn: conn, r: br}
+
+	switch {
+	case b[0] == 5 && m.SOCKS5 != nil:
+		return m.SOCKS5.Handle(ctx, pconn)
+	case b[0] == 4 && m.SOCKS4 != nil:
+		return m.SOCKS4.Handle(ctx, pconn)
+	case b[0] == 0x16 && m.HTTPS != nil: // TLS handshake record
+		return m.HTTPS.ServeConn(pconn)
+	case b[0] >= 'A' && b[0] <= 'Z' && m.HTTP != nil: // request method
+		return m.HTTP.ServeConn(pconn)
+	default:
+		conn.Close()
+		return errors.New("Handle: unrecognised protocol, first byte: " + strconv.Itoa(int(b[0])))
+	}
+}
+
+// peekedConn is a net.Conn whose reads are served through r,
+// which may contain data that was already read from the connection.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Unwrap returns the connection wrapped by c, once the data buffered by
+// r has been consumed, nil before.
+func (c *peekedConn) Unwrap() net.Conn {
+	if c.r.Buffered() > 0 {
+		return nil
+	}
+	return c.Conn
+}
+
+// CloseWrite closes the write side of the connection, if supported.
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("CloseWrite: not supported by " + c.Conn.LocalAddr().Network() + " connections")
+}
@@ -0,0 +1,316 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package proxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/booster-proj/proxy"
+	"github.com/booster-proj/proxy/dialer"
+	proxy_http "github.com/booster-proj/proxy/http"
+	"github.com/booster-proj/proxy/socks5"
+)
+
+// echo starts a TCP server that writes back what it reads,
+// returning its address.
+func echo(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// serveMux makes m handle the connections accepted on a loopback
+// listener, returning the address of the listener.
+func serveMux(t *testing.T, m *proxy.Mux) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go m.Handle(context.Background(), conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// socks4Dialer opens connections using the SOCKS4 protocol.
+type socks4Dialer string
+
+func (addr socks4Dialer) DialContext(ctx context.Context, network, target string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", string(addr))
+	if err != nil {
+		return nil, err
+	}
+
+	taddr, err := net.ResolveTCPAddr("tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	req := []byte{4, 1, byte(taddr.Port >> 8), byte(taddr.Port)}
+	req = append(req, taddr.IP.To4()...)
+	req = append(req, 0) // empty user id
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(conn, req[:8]); err != nil {
+		return nil, err
+	}
+	if req[1] != 90 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return conn, nil
+}
+
+func TestMux(t *testing.T) {
+	// borrow the certificate of a test server
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	roots := ts.Client().Transport.(*http.Transport).TLSClientConfig
+
+	m := proxy.NewMux()
+	m.HTTPS = proxy_http.NewTLS(&tls.Config{Certificates: ts.TLS.Certificates})
+	addr := serveMux(t, m)
+
+	https := proxy_http.NewClient(addr)
+	https.TLSConfig = roots
+
+	var tests = []struct {
+		name string
+		d    dialer.Dialer
+	}{
+		{name: "socks5", d: socks5.NewClient(addr)},
+		{name: "socks4", d: socks4Dialer(addr)},
+		{name: "http", d: proxy_http.NewClient(addr)},
+		{name: "https", d: https},
+	}
+
+	target := echo(t)
+	for _, test := range tests {
+		conn, err := test.d.DialContext(context.Background(), "tcp", target)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		msg := []byte("hello")
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Fatalf("%v: unexpected data. Wanted %q, found %q", test.name, msg, buf)
+		}
+		conn.Close()
+	}
+}
+
+func TestMuxHTTP(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "body")
+	}))
+	defer origin.Close()
+
+	u := &url.URL{Scheme: "http", Host: serveMux(t, proxy.NewMux())}
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+
+	// the same connection is reused by subsequent requests.
+	for i := 0; i < 2; i++ {
+		resp, err := c.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(b) != "body" {
+			t.Fatalf("unexpected body: %q", b)
+		}
+	}
+}
+
+func TestMuxShutdown(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "body")
+	}))
+	defer origin.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- proxy.NewMux().Serve(ctx, ln) }()
+
+	// two connections are handed to the same HTTP server.
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		req, _ := http.NewRequest("GET", origin.URL, nil)
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		conns = append(conns, conn)
+	}
+
+	// the idle keep-alive connections are closed with the mux.
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected the connection to be closed, found %v", err)
+		}
+	}
+}
+
+func TestMuxTunnel(t *testing.T) {
+	// the target sends its data and closes its write side, but
+	// keeps reading until the client does the same.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, "hello")
+				conn.(*net.TCPConn).CloseWrite()
+				b, _ := ioutil.ReadAll(conn)
+				received <- string(b)
+			}()
+		}
+	}()
+
+	opened := make(chan net.Conn, 1)
+	m := proxy.NewMux()
+	m.SOCKS5.Relay.OnOpen = func(src, dst net.Conn) { opened <- src }
+	m.HTTP.Relay.OnOpen = func(src, dst net.Conn) { opened <- src }
+	addr := serveMux(t, m)
+
+	var tests = []struct {
+		name string
+		d    dialer.Dialer
+	}{
+		{name: "socks5", d: socks5.NewClient(addr)},
+		{name: "http", d: proxy_http.NewClient(addr)},
+	}
+
+	for _, test := range tests {
+		conn, err := test.d.DialContext(context.Background(), "tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		// the client connection can be spliced.
+		src := <-opened
+		w, ok := src.(interface{ Unwrap() net.Conn })
+		if !ok {
+			t.Fatalf("%v: connection %T cannot be unwrapped", test.name, src)
+		}
+		if _, ok := w.Unwrap().(*net.TCPConn); !ok {
+			t.Fatalf("%v: unexpected unwrapped connection: %T", test.name, w.Unwrap())
+		}
+
+		// the half-close of the target reaches the client, which
+		// can still send data.
+		b, err := ioutil.ReadAll(conn)
+		if err != nil || string(b) != "hello" {
+			t.Fatalf("%v: unexpected data: %q, %v", test.name, b, err)
+		}
+		io.WriteString(conn, "later")
+		conn.(interface{ CloseWrite() error }).CloseWrite()
+
+		select {
+		case s := <-received:
+			if s != "later" {
+				t.Fatalf("%v: unexpected data received by the target: %q", test.name, s)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v: data not received by the target", test.name)
+		}
+		conn.Close()
+	}
+}
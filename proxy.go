@@ -28,10 +28,17 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
 
 	"github.com/booster-proj/proxy/dialer"
 	"github.com/booster-proj/proxy/http"
+	"github.com/booster-proj/proxy/socks4"
 	"github.com/booster-proj/proxy/socks5"
 )
 
@@ -40,8 +47,12 @@ type Proxy interface {
 	// Protocol is the string representation of the protocol
 	// beign used.
 	Protocol() string
-	// ListenAndServe reveleas the proxy to the network.
-	ListenAndServe(ctx context.Context, port int) error
+	// ListenAndServe reveleas the proxy to the network, listening
+	// on the TCP address addr.
+	ListenAndServe(ctx context.Context, addr string) error
+	// Serve makes the proxy handle the connections accepted on ln,
+	// until ctx is canceled. ln is closed when Serve returns.
+	Serve(ctx context.Context, ln net.Listener) error
 	// DialWith makes the proxy dial new connections with the
 	// assigned dialer.
 	DialWith(d dialer.Dialer)
@@ -56,6 +67,8 @@ const (
 	HTTPS
 	SOCKS5
 	Unknown
+	SOCKS4
+	Auto // detects the protocol of each client
 )
 
 // ParseProto takes a string as input and returns its Protocol value,
@@ -68,6 +81,10 @@ func ParseProto(s string) (Protocol, error) {
 		return HTTPS, nil
 	case "socks5", "SOCKS5":
 		return SOCKS5, nil
+	case "socks4", "SOCKS4", "socks4a", "SOCKS4A":
+		return SOCKS4, nil
+	case "auto", "AUTO":
+		return Auto, nil
 	default:
 		return Unknown, fmt.Errorf("unrecognised proto: %s", s)
 	}
@@ -80,9 +97,100 @@ func NewHTTP() (Proxy, error) {
 	return http.New(), nil
 }
 
+// NewHTTPS returns a new HTTP proxy instance that serves its clients over
+// TLS, using the certificate and private key stored in the PEM encoded cert
+// and key files. If one or more clientCAs files are provided, only the
+// clients presenting a certificate signed by one of those authorities are
+// allowed to use the proxy.
+func NewHTTPS(cert, key string, clientCAs ...string) (Proxy, error) {
+	c, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, errors.New("NewHTTPS: " + err.Error())
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{c},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if len(clientCAs) > 0 {
+		pool := x509.NewCertPool()
+		for _, ca := range clientCAs {
+			b, err := ioutil.ReadFile(ca)
+			if err != nil {
+				return nil, errors.New("NewHTTPS: " + err.Error())
+			}
+			if !pool.AppendCertsFromPEM(b) {
+				return nil, errors.New("NewHTTPS: no certificates found in " + ca)
+			}
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return http.NewTLS(config), nil
+}
+
 // NewSOCKS5 returns a new SOCKS5 proxy instance that speaks the protocol assigned.
 // d can also be nil, in that case the proxy will use a default dialer,
 // usually a bare net.Dialer.
 func NewSOCKS5() (Proxy, error) {
 	return socks5.New(), nil
 }
+
+// NewSOCKS4 returns a new SOCKS4 proxy instance, which also supports the
+// SOCKS4a extension.
+func NewSOCKS4() (Proxy, error) {
+	return socks4.New(), nil
+}
+
+// NewAuto returns a new proxy instance that serves HTTP, SOCKS5 and SOCKS4
+// clients on the same port. See Mux.
+func NewAuto() (Proxy, error) {
+	return NewMux(), nil
+}
+
+// ParseUpstream returns a dialer that connects through the upstream proxy
+// described by rawurl, in the scheme://[user:password@]host[:port] form.
+// The supported schemes are socks5, http and https, whose default ports are
+// 1080, 80 and 443. forward is used to connect to the upstream proxy, if
+// not nil.
+func ParseUpstream(rawurl string, forward dialer.Dialer) (dialer.Dialer, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.New("ParseUpstream: " + err.Error())
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("ParseUpstream: missing host: " + rawurl)
+	}
+	if forward == nil {
+		forward = dialer.Default
+	}
+
+	addr := func(port string) string {
+		if u.Port() != "" {
+			port = u.Port()
+		}
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	pass, _ := u.User.Password()
+
+	switch u.Scheme {
+	case "socks5":
+		c := socks5.NewClient(addr("1080"))
+		c.Username, c.Password = u.User.Username(), pass
+		c.Forward = forward
+		return c, nil
+	case "http", "https":
+		c := http.NewClient(addr("80"))
+		if u.Scheme == "https" {
+			c.Addr = addr("443")
+			c.TLSConfig = &tls.Config{ServerName: u.Hostname()}
+		}
+		c.Username, c.Password = u.User.Username(), pass
+		c.Forward = forward
+		return c, nil
+	default:
+		return nil, errors.New("ParseUpstream: unsupported scheme: " + u.Scheme)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/booster-proj/proxy"
+	proxy_http "github.com/booster-proj/proxy/http"
+	"github.com/booster-proj/proxy/socks5"
+)
+
+func TestParseUpstream(t *testing.T) {
+	addr := serveMux(t, proxy.NewMux())
+	target := echo(t)
+
+	for _, rawurl := range []string{"socks5://" + addr, "http://" + addr, "http://user:pass@" + addr} {
+		d, err := proxy.ParseUpstream(rawurl, nil)
+		if err != nil {
+			t.Fatalf("%v: %v", rawurl, err)
+		}
+		conn, err := d.DialContext(context.Background(), "tcp", target)
+		if err != nil {
+			t.Fatalf("%v: %v", rawurl, err)
+		}
+
+		msg := []byte("hello")
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("%v: %v", rawurl, err)
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Fatalf("%v: unexpected data. Wanted %q, found %q", rawurl, msg, buf)
+		}
+		conn.Close()
+	}
+}
+
+func TestParseUpstreamAddr(t *testing.T) {
+	var tests = []struct {
+		in   string
+		addr string
+	}{
+		{in: "socks5://proxy.test", addr: "proxy.test:1080"},
+		{in: "http://proxy.test", addr: "proxy.test:80"},
+		{in: "https://proxy.test", addr: "proxy.test:443"},
+		{in: "https://proxy.test:8443", addr: "proxy.test:8443"},
+		{in: "ftp://proxy.test"},
+		{in: "socks5://"},
+	}
+
+	for _, test := range tests {
+		d, err := proxy.ParseUpstream(test.in, nil)
+		if test.addr == "" {
+			if err == nil {
+				t.Fatalf("%v: expected an error", test.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", test.in, err)
+		}
+
+		var addr string
+		switch c := d.(type) {
+		case *socks5.Client:
+			addr = c.Addr
+		case *proxy_http.Client:
+			addr = c.Addr
+			if (c.TLSConfig != nil) != (test.in[:5] == "https") {
+				t.Fatalf("%v: unexpected TLS config: %v", test.in, c.TLSConfig)
+			}
+		}
+		if addr != test.addr {
+			t.Fatalf("%v: unexpected address: wanted %v, found %v", test.in, test.addr, addr)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package socks4
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// DefaultBindTimeout is the default duration the proxy waits for an
+// inbound connection after a BIND request.
+const DefaultBindTimeout = 2 * time.Minute
+
+// Bind waits for an inbound connection from the host that target
+// refers to. The client receives two replies: the first one contains
+// the address the proxy is listening on, the second one is sent when
+// the host connects. If target contains an IP address that is not
+// unspecified, connections coming from other hosts are rejected.
+func (s *Proxy) Bind(ctx context.Context, conn net.Conn, target string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, errors.New("Bind: " + err.Error())
+	}
+	peer := net.ParseIP(host)
+	if peer != nil && peer.IsUnspecified() {
+		peer = nil
+	}
+
+	// listen on the same address of the control connection
+	laddr := new(net.TCPAddr)
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		laddr.IP = addr.IP
+	}
+	ln, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		writeReply(conn, socks4RespRejected, nil)
+		return nil, errors.New("Bind: unable to listen: " + err.Error())
+	}
+	defer ln.Close()
+
+	if err := writeReply(conn, socks4RespGranted, ln.Addr()); err != nil {
+		return nil, errors.New("Bind: unable to write first bind response: " + err.Error())
+	}
+
+	timeout := s.BindTimeout
+	if timeout == 0 {
+		timeout = DefaultBindTimeout
+	}
+	ln.SetDeadline(time.Now().Add(timeout))
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ln.Close()
+		case <-done:
+		}
+	}()
+
+	pconn, err := ln.AcceptTCP()
+	if err != nil {
+		writeReply(conn, socks4RespRejected, nil)
+		return nil, errors.New("Bind: unable to accept inbound connection: " + err.Error())
+	}
+
+	raddr := pconn.RemoteAddr().(*net.TCPAddr)
+	if peer != nil && !peer.Equal(raddr.IP) {
+		pconn.Close()
+		writeReply(conn, socks4RespRejected, raddr)
+		return nil, errors.New("Bind: unexpected connection from " + raddr.String())
+	}
+
+	if err := writeReply(conn, socks4RespGranted, raddr); err != nil {
+		pconn.Close()
+		return nil, errors.New("Bind: unable to write second bind response: " + err.Error())
+	}
+
+	return pconn, nil
+}
@@ -0,0 +1,323 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package socks4 provides a SOCKS4 server implementation, including
+// the SOCKS4a extension that allows clients to specify the destination
+// using a host name.
+package socks4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/booster-proj/proxy/dialer"
+	"github.com/booster-proj/proxy/transmit"
+	"upspin.io/log"
+)
+
+const (
+	socks4Version = uint8(4)
+	// replies use a null version field.
+	socks4ReplyVersion = uint8(0)
+)
+
+// Possible CD field values in requests
+const (
+	socks4CmdConnect = uint8(1)
+	socks4CmdBind    = uint8(2)
+)
+
+// Possible CD field values in replies
+const (
+	socks4RespGranted  = uint8(90)
+	socks4RespRejected = uint8(91)
+)
+
+// maxStringLen is the maximum length accepted for the null terminated
+// USERID and host name fields.
+const maxStringLen = 255
+
+// DefaultIdleTimeout is the idle timeout of the tunnels opened by the clients, used
+// by the proxies returned by New.
+const DefaultIdleTimeout = 10 * time.Minute
+
+// DefaultDialTimeout is the default maximum duration the proxy waits for
+// the connection to the destination requested by a client.
+const DefaultDialTimeout = 10 * time.Second
+
+// Proxy represents a SOCKS4 proxy server implementation.
+type Proxy struct {
+	dialer.Dialer
+
+	// DialTimeout is the maximum duration the proxy waits for the
+	// connection to the destination requested by a client. If zero,
+	// DefaultDialTimeout is used.
+	DialTimeout time.Duration
+
+	// BindTimeout is the maximum duration the proxy waits for an
+	// inbound connection after a BIND request. If zero,
+	// DefaultBindTimeout is used.
+	BindTimeout time.Duration
+
+	// OnSession, if not nil, is called each time a tunnel opened by
+	// a client is closed. It is called synchronously, before the
+	// client connection is closed.
+	OnSession func(transmit.Session)
+
+	// Relay copies the data of the tunnels opened by the clients.
+	// Its timeouts, buffers and throttling can be configured.
+	Relay transmit.Relay
+}
+
+// New returns a new Proxy instance.
+func New() *Proxy {
+	return &Proxy{
+		Dialer: dialer.Default,
+		Relay: transmit.Relay{
+			IdleTimeout: DefaultIdleTimeout,
+			BufferSize:  int(transmit.DTU),
+		},
+	}
+}
+
+// DialWith make the receiver use d for dialing TCP connections, if d != nil.
+func (s *Proxy) DialWith(d dialer.Dialer) {
+	if d != nil {
+		s.Dialer = d
+	}
+}
+
+// ListenAndServe listens on the TCP network address addr and then calls
+// Serve to handle the incoming connections.
+func (s *Proxy) ListenAndServe(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, ln)
+}
+
+// Serve accepts the connections on ln, handling each of them using
+// the SOCKS4 protocol.
+// Serve closes ln when returning, which happens when ln fails or ctx
+// is canceled.
+func (s *Proxy) Serve(ctx context.Context, ln net.Listener) error {
+	defer ln.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				errc <- fmt.Errorf("Serve: cannot accept conn: %v", err)
+				return
+			}
+
+			go func() {
+				if err := s.Handle(ctx, conn); err != nil {
+					log.Error.Println(err)
+				}
+			}()
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		ln.Close()
+		<-errc // wait for listener to return
+		return ctx.Err()
+	}
+}
+
+func (s *Proxy) Protocol() string {
+	return "socks4"
+}
+
+// Handle serves a SOCKS4 or SOCKS4a request.
+//
+// Should run in its own go routine, closes the connection
+// when returning.
+func (s *Proxy) Handle(ctx context.Context, conn net.Conn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer conn.Close()
+
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return errors.New("Handle: unable to read request: " + err.Error())
+	}
+
+	v := buf[0]   // protocol version
+	cmd := buf[1] // command to execute
+	port := int(buf[2])<<8 | int(buf[3])
+	ip := net.IP(buf[4:8])
+
+	// Check version number
+	if v != socks4Version {
+		return errors.New("Handle: unsupported version: " + strconv.Itoa(int(v)))
+	}
+
+	userID, err := readString(conn)
+	if err != nil {
+		return errors.New("Handle: unable to read user id: " + err.Error())
+	}
+
+	host := ip.String()
+	if isSOCKS4a(ip) {
+		// the host name to resolve follows the user id.
+		if host, err = readString(conn); err != nil {
+			return errors.New("Handle: unable to read host name: " + err.Error())
+		}
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+
+	log.Debug.Printf("Handle: performing [%v] to: %v user(%v)", prettyCmd(cmd), target, userID)
+
+	var tconn net.Conn
+	timeout := s.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	_ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	switch cmd {
+	case socks4CmdConnect:
+		tconn, err = s.Connect(_ctx, conn, target)
+	case socks4CmdBind:
+		tconn, err = s.Bind(ctx, conn, target)
+	default:
+		writeReply(conn, socks4RespRejected, nil)
+		return errors.New("Handle: unexpected CD(" + strconv.Itoa(int(cmd)) + ")")
+	}
+	if err != nil {
+		return errors.New("Handle: unable to perform CD(" + strconv.Itoa(int(cmd)) + "): " + err.Error())
+	}
+	defer tconn.Close()
+
+	// start proxying
+	sess := transmit.Session{
+		Protocol: s.Protocol(),
+		User:     userID,
+		Source:   conn.RemoteAddr().String(),
+		Target:   target,
+		Start:    time.Now(),
+	}
+	ptp := fmt.Sprintf("%v <-> %v (%v) user(%v)", conn.LocalAddr(), tconn.RemoteAddr(), target, userID)
+
+	log.Info.Printf("Open: %v", ptp)
+
+	sess.Stats, err = s.Relay.Data(ctx, conn, tconn)
+
+	log.Info.Printf("Close: %v d(%v) sent(%d) recv(%d) reason(%v)", ptp, sess.Duration, sess.BytesSent, sess.BytesReceived, sess.Reason)
+	if s.OnSession != nil {
+		s.OnSession(sess)
+	}
+
+	if err != nil {
+		return errors.New(ptp + ": " + err.Error())
+	}
+	return nil
+}
+
+// Connect dials a new connection with target, which must be a canonical
+// address with host and port.
+func (s *Proxy) Connect(ctx context.Context, conn net.Conn, target string) (net.Conn, error) {
+	tconn, err := s.DialContext(ctx, "tcp", target)
+	if err != nil {
+		if err := writeReply(conn, socks4RespRejected, nil); err != nil {
+			return nil, errors.New("Connect: unable to write connect response: " + err.Error())
+		}
+		return nil, err
+	}
+
+	if err := writeReply(conn, socks4RespGranted, tconn.LocalAddr()); err != nil {
+		tconn.Close()
+		return nil, errors.New("Connect: unable to write connect response: " + err.Error())
+	}
+
+	return tconn, nil
+}
+
+// isSOCKS4a reports whether ip is in the form 0.0.0.x, with x != 0,
+// which SOCKS4a clients use to signal that a host name follows.
+func isSOCKS4a(ip net.IP) bool {
+	return ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0
+}
+
+// readString reads a null terminated string from r, one byte at a time
+// to avoid consuming data that follows the request.
+func readString(r io.Reader) (string, error) {
+	buf := make([]byte, 0, 16)
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		if len(buf) == maxStringLen {
+			return "", errors.New("string too long")
+		}
+		buf = append(buf, b[0])
+	}
+}
+
+// writeReply writes a SOCKS4 reply to w, using cd as CD field. addr
+// fills the DSTPORT and DSTIP fields, which are zero if addr is nil or
+// is not an IPv4 address.
+func writeReply(w io.Writer, cd uint8, addr net.Addr) error {
+	buf := make([]byte, 8)
+	buf[0] = socks4ReplyVersion
+	buf[1] = cd
+
+	if addr, ok := addr.(*net.TCPAddr); ok {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			buf[2], buf[3] = byte(addr.Port>>8), byte(addr.Port)
+			copy(buf[4:], ip4)
+		}
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func prettyCmd(cmd uint8) string {
+	switch cmd {
+	case socks4CmdConnect:
+		return "Connect"
+	case socks4CmdBind:
+		return "Bind"
+	default:
+		return "Undefined"
+	}
+}
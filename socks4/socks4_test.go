@@ -0,0 +1,192 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package socks4_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/booster-proj/proxy/socks4"
+)
+
+// serve makes s handle the connections accepted on a loopback
+// listener, returning the address of the listener.
+func serve(t *testing.T, s *socks4.Proxy) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.Handle(context.Background(), conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// echo starts a TCP server that writes back what it reads.
+func echo(t *testing.T) *net.TCPAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func TestConnect(t *testing.T) {
+	addr := serve(t, socks4.New())
+	target := echo(t)
+	port := []byte{byte(target.Port >> 8), byte(target.Port)}
+
+	var tests = []struct {
+		in []byte
+		cd byte
+	}{
+		{in: append(append([]byte{4, 1}, port...), 127, 0, 0, 1, 'i', 'd', 0), cd: 90},                                     // SOCKS4
+		{in: append(append([]byte{4, 1}, port...), 0, 0, 0, 1, 0, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0), cd: 90}, // SOCKS4a
+		{in: append(append([]byte{4, 3}, port...), 127, 0, 0, 1, 0), cd: 91},                                               // unknown command
+	}
+
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if _, err := conn.Write(test.in); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 8)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf[0] != 0 || buf[1] != test.cd {
+			t.Fatalf("unexpected reply. Wanted CD(%d), found %v", test.cd, buf)
+		}
+		if test.cd != 90 {
+			continue
+		}
+
+		msg := []byte("hello")
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, buf[:len(msg)]); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:len(msg)], msg) {
+			t.Fatalf("unexpected data. Wanted %q, found %q", msg, buf[:len(msg)])
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	addr := serve(t, socks4.New())
+
+	var tests = []struct {
+		dstip []byte
+		cd    byte
+	}{
+		{dstip: []byte{127, 0, 0, 1}, cd: 90},
+		{dstip: []byte{0, 0, 0, 0}, cd: 90}, // any host
+		{dstip: []byte{192, 0, 2, 1}, cd: 91},
+	}
+
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		req := append(append([]byte{4, 2, 0, 0}, test.dstip...), 0)
+		if _, err := conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 8)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf[1] != 90 {
+			t.Fatalf("%v: unexpected first reply: %v", test.dstip, buf)
+		}
+		baddr := &net.TCPAddr{IP: net.IP(buf[4:8]), Port: int(buf[2])<<8 | int(buf[3])}
+
+		peer, err := net.DialTCP("tcp", nil, baddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf[1] != test.cd {
+			t.Fatalf("%v: unexpected second reply. Wanted CD(%d), found %v", test.dstip, test.cd, buf)
+		}
+		if test.cd != 90 {
+			continue
+		}
+
+		msg := []byte("hello")
+		if _, err := peer.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, buf[:len(msg)]); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:len(msg)], msg) {
+			t.Fatalf("%v: unexpected data. Wanted %q, found %q", test.dstip, msg, buf[:len(msg)])
+		}
+	}
+}
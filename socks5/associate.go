@@ -25,21 +25,334 @@ SOFTWARE.
 package socks5
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"io"
+	"io/ioutil"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/booster-proj/proxy/dialer"
+	"upspin.io/log"
 )
 
-// associate -- not yet implemented. See RFC 1928
-func (s *Proxy) Associate(ctx context.Context, conn net.Conn, target string) (net.Conn, error) {
+// maxDatagramSize is the maximum size of an UDP payload.
+const maxDatagramSize = 65507
+
+// DefaultUDPIdleTimeout is the default duration after which the
+// connection to a destination of an UDP association is closed, if no
+// datagrams are exchanged with it.
+const DefaultUDPIdleTimeout = 2 * time.Minute
+
+// DefaultMaxUDPDestinations is the default maximum number of
+// destinations an UDP association can exchange datagrams with at the
+// same time.
+const DefaultMaxUDPDestinations = 256
+
+// Associate establishes an UDP relay for the client, as described in
+// RFC 1928. target is the address that the client expects to use to
+// send datagrams, and may be zero if it is not known by the client
+// yet. Only datagrams coming from the host that opened the
+// association are relayed. Datagrams are forwarded to their
+// destinations using connections obtained from the receiver's dialer,
+// which should support the "udp" network. The connection to each
+// destination is closed after UDPIdleTimeout without datagrams, and at
+// most MaxUDPDestinations destinations can be used at the same time.
+//
+// Associate returns when conn, the control connection, is closed or
+// ctx is done.
+func (s *Proxy) Associate(ctx context.Context, conn net.Conn, target string) error {
+	_, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return errors.New("Associate: " + err.Error())
+	}
+	cport, _ := strconv.Atoi(port)
+
+	// listen on the same address of the control connection
+	laddr := new(net.UDPAddr)
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		laddr.IP = addr.IP
+	}
+	pconn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		writeReply(conn, replyCode(err), nil)
+		return errors.New("Associate: unable to listen: " + err.Error())
+	}
+	defer pconn.Close()
+
+	if err := writeReply(conn, socks5RespSuccess, pconn.LocalAddr()); err != nil {
+		return errors.New("Associate: unable to write associate response: " + err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	r := &udpRelay{
+		Dialer:      s.Dialer,
+		pconn:       pconn,
+		idleTimeout: s.UDPIdleTimeout,
+		maxDests:    s.MaxUDPDestinations,
+		client:      &net.UDPAddr{Port: cport},
+		dests:       make(map[string]*udpDest),
+	}
+	if r.idleTimeout == 0 {
+		r.idleTimeout = DefaultUDPIdleTimeout
+	}
+	if r.maxDests == 0 {
+		r.maxDests = DefaultMaxUDPDestinations
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		r.client.IP = addr.IP
+	}
+	defer r.Close()
+
+	// the association terminates when the control connection does.
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		cancel()
+	}()
+	go func() {
+		<-ctx.Done()
+		pconn.Close()
+	}()
+
+	log.Info.Printf("Associate: %v <-> %v", r.client, pconn.LocalAddr())
+	defer log.Info.Printf("Associate: %v closed", pconn.LocalAddr())
+
+	if err := r.serve(ctx); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// udpRelay forwards the datagrams received from a client to their
+// destinations and the other way around.
+type udpRelay struct {
+	dialer.Dialer
+	pconn       *net.UDPConn
+	idleTimeout time.Duration
+	maxDests    int
+
+	sync.Mutex
+	client *net.UDPAddr
+	dests  map[string]*udpDest // destination -> connection
+	closed bool
+}
 
-	// cap is just an estimation
-	buf := make([]byte, 0, 6+len(target))
-	buf = append(buf, socks5Version, socks5RespCommandNotSupported, socks5FieldReserved)
+// udpDest is the connection used to reach a destination.
+type udpDest struct {
+	ready chan struct{} // closed when the dial completes
+	conn  net.Conn      // nil if the dial failed
+	last  int64         // unix nano time of the last datagram
+}
+
+func (d *udpDest) touch() {
+	atomic.StoreInt64(&d.last, time.Now().UnixNano())
+}
+
+func (d *udpDest) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&d.last)))
+}
+
+func (r *udpRelay) serve(ctx context.Context) error {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := r.pconn.ReadFromUDP(buf)
+		if err != nil {
+			return errors.New("Associate: unable to read datagram: " + err.Error())
+		}
+		if !r.accept(addr) {
+			log.Debug.Printf("Associate: dropping datagram from unexpected source %v", addr)
+			continue
+		}
+
+		target, data, err := ReadDatagram(buf[:n])
+		if err != nil {
+			log.Debug.Printf("Associate: dropping datagram: %v", err)
+			continue
+		}
+		r.forward(ctx, target, data)
+	}
+}
+
+// accept reports whether addr is the address of the client. The
+// port of the client is learned from the first datagram, if not
+// provided when the association was requested.
+func (r *udpRelay) accept(addr *net.UDPAddr) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.client.IP != nil && !r.client.IP.Equal(addr.IP) {
+		return false
+	}
+	if r.client.Port == 0 {
+		r.client.Port = addr.Port
+	}
+	return r.client.Port == addr.Port
+}
 
-	if _, err := conn.Write(buf); err != nil {
-		return nil, errors.New("proxy: unable to write associate response: " + err.Error())
+// forward sends data to target. The connection to a new destination is
+// dialed in its own go routine, so that a slow dial does not delay the
+// datagrams directed to the other destinations; the datagrams sent to
+// the destination in the meantime are dropped.
+func (r *udpRelay) forward(ctx context.Context, target string, data []byte) {
+	r.Lock()
+	d, ok := r.dests[target]
+	if !ok {
+		if len(r.dests) >= r.maxDests {
+			r.Unlock()
+			log.Debug.Printf("Associate: dropping datagram to %v: too many destinations", target)
+			return
+		}
+		d = &udpDest{ready: make(chan struct{})}
+		r.dests[target] = d
 	}
+	r.Unlock()
+
+	if !ok {
+		go r.dial(ctx, target, d, append([]byte(nil), data...))
+		return
+	}
+
+	select {
+	case <-d.ready:
+	default:
+		log.Debug.Printf("Associate: dropping datagram to %v: still connecting", target)
+		return
+	}
+	if d.conn == nil {
+		return
+	}
+	d.touch()
+	if _, err := d.conn.Write(data); err != nil {
+		log.Debug.Printf("Associate: unable to forward datagram to %v: %v", target, err)
+	}
+}
+
+// dial connects d to target, sends the first datagram and then relays
+// the replies until the destination is idle.
+func (r *udpRelay) dial(ctx context.Context, target string, d *udpDest, first []byte) {
+	conn, err := r.DialContext(ctx, "udp", target)
+
+	r.Lock()
+	if err == nil && r.closed {
+		conn.Close()
+		err = errors.New("association closed")
+	}
+	if err != nil {
+		delete(r.dests, target)
+	} else {
+		d.conn = conn
+	}
+	r.Unlock()
+	close(d.ready)
+
+	if err != nil {
+		log.Debug.Printf("Associate: dropping datagram to %v: %v", target, err)
+		return
+	}
+
+	d.touch()
+	if _, err := conn.Write(first); err != nil {
+		log.Debug.Printf("Associate: unable to forward datagram to %v: %v", target, err)
+	}
+	r.reply(target, d)
+}
+
+// reply sends back to the client the datagrams received from the
+// connection of d. The connection is closed and forgotten after
+// idleTimeout without datagrams in either direction.
+func (r *udpRelay) reply(target string, d *udpDest) {
+	defer func() {
+		r.Lock()
+		if r.dests[target] == d {
+			delete(r.dests, target)
+		}
+		r.Unlock()
+		d.conn.Close()
+	}()
+
+	hdr, err := EncodeDatagram(d.conn.RemoteAddr().String(), nil)
+	if err != nil {
+		log.Debug.Printf("Associate: %v", err)
+		return
+	}
+
+	buf := make([]byte, len(hdr)+maxDatagramSize)
+	copy(buf, hdr)
+	for {
+		d.conn.SetReadDeadline(time.Now().Add(r.idleTimeout - d.idle()))
+		n, err := d.conn.Read(buf[len(hdr):])
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if d.idle() >= r.idleTimeout {
+				log.Debug.Printf("Associate: %v idle, closing", target)
+				return
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		d.touch()
+		r.Lock()
+		client := *r.client
+		r.Unlock()
+		if _, err := r.pconn.WriteToUDP(buf[:len(hdr)+n], &client); err != nil {
+			return
+		}
+	}
+}
+
+// Close closes every connection opened by the relay.
+func (r *udpRelay) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.closed = true
+	for _, d := range r.dests {
+		if d.conn != nil {
+			d.conn.Close()
+		}
+	}
+	return nil
+}
+
+// ReadDatagram parses an UDP datagram encapsulated as described in
+// RFC 1928, returning its destination address and its payload.
+// Fragmented datagrams are not supported.
+func ReadDatagram(b []byte) (addr string, data []byte, err error) {
+	if len(b) < 3 {
+		return "", nil, errors.New("ReadDatagram: datagram too short")
+	}
+	if frag := b[2]; frag != 0 {
+		return "", nil, errors.New("ReadDatagram: fragmentation not supported")
+	}
+
+	r := bytes.NewReader(b[3:])
+	if addr, err = ReadAddress(r); err != nil {
+		return "", nil, err
+	}
+
+	return addr, b[len(b)-r.Len():], nil
+}
+
+// EncodeDatagram encapsulates data in an UDP datagram addressed to
+// addr, as described in RFC 1928.
+func EncodeDatagram(addr string, data []byte) ([]byte, error) {
+	abuf, err := EncodeAddressBinary(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, 3+len(abuf)+len(data))
+	buf = append(buf, socks5FieldReserved, socks5FieldReserved, 0) // RSV, FRAG
+	buf = append(buf, abuf...)
+	buf = append(buf, data...)
 
-	return nil, errors.New("proxy: associate command not supported")
+	return buf, nil
 }
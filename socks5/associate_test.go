@@ -0,0 +1,212 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package socks5_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/booster-proj/proxy/dialer"
+	"github.com/booster-proj/proxy/socks5"
+)
+
+func TestAssociate(t *testing.T) {
+	echo := udpEcho(t)
+
+	addr := serve(t, socks5.New())
+	ctrl, raddr := request(t, addr, 3, "0.0.0.0:0", 0)
+
+	relay, err := net.ResolveUDPAddr("udp", raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msg := []byte("hello")
+	out, err := socks5.EncodeDatagram(echo, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(out); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, data, err := socks5.ReadDatagram(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src != echo {
+		t.Fatalf("unexpected source address. Wanted %v, found %v", echo, src)
+	}
+	if !bytes.Equal(data, msg) {
+		t.Fatalf("unexpected payload. Wanted %q, found %q", msg, data)
+	}
+
+	// closing the control connection tears down the relay.
+	ctrl.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	conn.Write(out)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Read(buf); err == nil {
+		t.Fatal("relay is still active after the control connection was closed")
+	}
+}
+
+func TestAssociateForeignSource(t *testing.T) {
+	addr := serve(t, socks5.New())
+
+	// the client declares the port it is going to use
+	_, raddr := request(t, addr, 3, "127.0.0.1:1", 0)
+
+	relay, err := net.ResolveUDPAddr("udp", raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	out, err := socks5.EncodeDatagram(target.LocalAddr().String(), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(out); err != nil {
+		t.Fatal(err)
+	}
+
+	target.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := target.ReadFrom(make([]byte, 512)); err == nil {
+		t.Fatal("datagram sent from an unexpected port was relayed")
+	}
+}
+
+// udpEcho starts an UDP server that writes back what it reads,
+// returning its address.
+func udpEcho(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// roundTrip sends a datagram to target through the relay connected to
+// conn, reporting whether it is echoed back.
+func roundTrip(t *testing.T, conn net.Conn, target string) bool {
+	out, err := socks5.EncodeDatagram(target, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(out); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 512)
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return false
+		}
+		// skip the late replies of previous round trips
+		if src, _, err := socks5.ReadDatagram(buf[:n]); err == nil && src == target {
+			return true
+		}
+	}
+}
+
+func TestAssociateLimits(t *testing.T) {
+	a, b, slow := udpEcho(t), udpEcho(t), udpEcho(t)
+
+	s := socks5.New()
+	s.UDPIdleTimeout = 100 * time.Millisecond
+	s.MaxUDPDestinations = 2
+	s.DialWith(dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == slow {
+			time.Sleep(time.Second)
+		}
+		return dialer.Default.DialContext(ctx, network, addr)
+	}))
+
+	_, raddr := request(t, serve(t, s), 3, "0.0.0.0:0", 0)
+	conn, err := net.Dial("udp", raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var tests = []struct {
+		sleep  time.Duration
+		target string
+		echoed bool
+	}{
+		{target: slow, echoed: false},                            // dialing, takes one of the slots
+		{target: a, echoed: true},                                // not delayed by the slow dial
+		{target: b, echoed: false},                               // too many destinations
+		{sleep: 200 * time.Millisecond, target: b, echoed: true}, // a expired
+	}
+
+	for i, test := range tests {
+		time.Sleep(test.sleep)
+		if echoed := roundTrip(t, conn, test.target); echoed != test.echoed {
+			t.Fatalf("%d: unexpected round trip result: wanted %v, found %v", i, test.echoed, echoed)
+		}
+	}
+}
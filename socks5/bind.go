@@ -28,18 +28,78 @@ import (
 	"context"
 	"errors"
 	"net"
+	"time"
 )
 
-// bind, not yet implemented. See RFC 1928
+// DefaultBindTimeout is the default duration the proxy waits for an
+// inbound connection after a BIND request.
+const DefaultBindTimeout = 2 * time.Minute
+
+// Bind waits for an inbound connection, as described in RFC 1928.
+// The client receives two replies: the first one contains the address
+// the proxy is listening on, the second one the address of the host
+// that connected to it. If target contains an IP address that is not
+// unspecified, connections coming from other hosts are rejected.
 func (s *Proxy) Bind(ctx context.Context, conn net.Conn, target string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, errors.New("Bind: " + err.Error())
+	}
+	peer := net.ParseIP(host)
+	if peer != nil && peer.IsUnspecified() {
+		peer = nil
+	}
+
+	// listen on the same address of the control connection
+	laddr := new(net.TCPAddr)
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		laddr.IP = addr.IP
+	}
+	ln, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		writeReply(conn, replyCode(err), nil)
+		return nil, errors.New("Bind: unable to listen: " + err.Error())
+	}
+	defer ln.Close()
 
-	// cap is just an estimation
-	buf := make([]byte, 0, 6+len(target))
-	buf = append(buf, socks5Version, socks5RespCommandNotSupported, socks5FieldReserved)
+	if err := writeReply(conn, socks5RespSuccess, ln.Addr()); err != nil {
+		return nil, errors.New("Bind: unable to write first bind response: " + err.Error())
+	}
 
-	if _, err := conn.Write(buf); err != nil {
-		return nil, errors.New("proxy: unable to write bind response: " + err.Error())
+	timeout := s.BindTimeout
+	if timeout == 0 {
+		timeout = DefaultBindTimeout
 	}
+	ln.SetDeadline(time.Now().Add(timeout))
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ln.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		pconn, err := ln.AcceptTCP()
+		if err != nil {
+			writeReply(conn, replyCode(err), nil)
+			return nil, errors.New("Bind: unable to accept inbound connection: " + err.Error())
+		}
 
-	return nil, errors.New("proxy: bind command not supported")
+		raddr := pconn.RemoteAddr().(*net.TCPAddr)
+		if peer != nil && !peer.Equal(raddr.IP) {
+			pconn.Close()
+			continue
+		}
+
+		if err := writeReply(conn, socks5RespSuccess, raddr); err != nil {
+			pconn.Close()
+			return nil, errors.New("Bind: unable to write second bind response: " + err.Error())
+		}
+
+		return pconn, nil
+	}
 }
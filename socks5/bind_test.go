@@ -0,0 +1,91 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package socks5_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/booster-proj/proxy/socks5"
+)
+
+func TestBind(t *testing.T) {
+	addr := serve(t, socks5.New())
+	conn, baddr := request(t, addr, 2, "0.0.0.0:0", 0)
+
+	peer, err := net.Dial("tcp", baddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	if paddr := readReply(t, conn, 0); paddr != peer.LocalAddr().String() {
+		t.Fatalf("unexpected peer address. Wanted %v, found %v", peer.LocalAddr(), paddr)
+	}
+
+	var tests = []struct {
+		src net.Conn
+		dst net.Conn
+	}{
+		{src: conn, dst: peer},
+		{src: peer, dst: conn},
+	}
+
+	for _, test := range tests {
+		msg := []byte("hello")
+		if _, err := test.src.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(test.dst, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Fatalf("unexpected data. Wanted %q, found %q", msg, buf)
+		}
+	}
+}
+
+func TestBindUnexpectedPeer(t *testing.T) {
+	s := socks5.New()
+	s.BindTimeout = 100 * time.Millisecond
+
+	addr := serve(t, s)
+	conn, baddr := request(t, addr, 2, "10.0.0.1:0", 0)
+
+	peer, err := net.Dial("tcp", baddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	// the connection is rejected, the proxy keeps waiting until
+	// the timeout expires (TTL expired).
+	readReply(t, conn, 6)
+}
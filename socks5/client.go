@@ -0,0 +1,240 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/booster-proj/proxy/dialer"
+)
+
+// Client is a dialer that opens TCP connections through an upstream
+// SOCKS5 proxy.
+type Client struct {
+	// Addr is the address of the upstream proxy.
+	Addr string
+
+	// Username and Password are used to authenticate with the
+	// upstream proxy (RFC 1929), when Username is not empty.
+	Username string
+	Password string
+
+	// Forward is used to connect to the upstream proxy. If nil,
+	// dialer.Default is used.
+	Forward dialer.Dialer
+}
+
+// NewClient returns a new Client instance that connects through the
+// SOCKS5 proxy listening on addr.
+func NewClient(addr string) *Client {
+	return &Client{
+		Addr:    addr,
+		Forward: dialer.Default,
+	}
+}
+
+// DialContext connects to addr through the upstream proxy. Only TCP
+// networks are supported.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.New("DialContext: unsupported network: " + network)
+	}
+
+	d := c.Forward
+	if d == nil {
+		d = dialer.Default
+	}
+	conn, err := d.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		// the failure concerns the upstream proxy, and must not
+		// be mistaken for one of the destination.
+		return nil, errors.New("DialContext: upstream proxy " + c.Addr + ": " + err.Error())
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.handshake(conn, addr)
+	}()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	case <-ctx.Done():
+		conn.Close()
+		<-errc // wait for the handshake to return
+		return nil, ctx.Err()
+	}
+}
+
+// handshake negotiates the authentication method with the upstream
+// proxy and requests a connection to addr.
+func (c *Client) handshake(rw io.ReadWriter, addr string) error {
+	abuf, err := EncodeAddressBinary(addr)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 0, 3+len(abuf))
+	if c.Username != "" {
+		buf = append(buf, socks5Version, 2, socks5MethodNoAuth, socks5MethodUsernamePassword)
+	} else {
+		buf = append(buf, socks5Version, 1, socks5MethodNoAuth)
+	}
+	if _, err := rw.Write(buf); err != nil {
+		return errors.New("handshake: unable to write negotiation: " + err.Error())
+	}
+
+	buf = buf[:2]
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return errors.New("handshake: unable to read negotiation response: " + err.Error())
+	}
+	if buf[0] != socks5Version {
+		return errors.New("handshake: unsupported version: " + strconv.Itoa(int(buf[0])))
+	}
+
+	switch m := buf[1]; m {
+	case socks5MethodNoAuth:
+	case socks5MethodUsernamePassword:
+		if err := c.authenticate(rw); err != nil {
+			return err
+		}
+	case socks5MethodNoAcceptableMethods:
+		return errors.New("handshake: no acceptable authentication method")
+	default:
+		return errors.New("handshake: unexpected method " + strconv.Itoa(int(m)))
+	}
+
+	buf = buf[:0]
+	buf = append(buf, socks5Version, socks5CmdConnect, socks5FieldReserved)
+	buf = append(buf, abuf...)
+	if _, err := rw.Write(buf); err != nil {
+		return errors.New("handshake: unable to write request: " + err.Error())
+	}
+
+	buf = buf[:3]
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return errors.New("handshake: unable to read reply: " + err.Error())
+	}
+	if buf[0] != socks5Version {
+		return errors.New("handshake: unsupported version: " + strconv.Itoa(int(buf[0])))
+	}
+	rep := buf[1]
+
+	// bnd addr and port are not used
+	if _, err := ReadAddress(rw); err != nil {
+		return err
+	}
+	if rep != socks5RespSuccess {
+		return &ReplyError{Code: rep}
+	}
+
+	return nil
+}
+
+// authenticate performs the username/password sub-negotiation
+// described in RFC 1929.
+func (c *Client) authenticate(rw io.ReadWriter) error {
+	if len(c.Username) > 255 || len(c.Password) > 255 {
+		return errors.New("authenticate: username or password too long")
+	}
+
+	buf := make([]byte, 0, 3+len(c.Username)+len(c.Password))
+	buf = append(buf, userPassVersion, byte(len(c.Username)))
+	buf = append(buf, c.Username...)
+	buf = append(buf, byte(len(c.Password)))
+	buf = append(buf, c.Password...)
+	if _, err := rw.Write(buf); err != nil {
+		return errors.New("authenticate: unable to write request: " + err.Error())
+	}
+
+	buf = buf[:2]
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return errors.New("authenticate: unable to read response: " + err.Error())
+	}
+	if buf[1] != userPassStatusSuccess {
+		return errors.New("authenticate: authentication failed for user " + c.Username)
+	}
+
+	return nil
+}
+
+// ReplyError is returned by Client when the upstream proxy replies
+// with a failure code.
+type ReplyError struct {
+	Code uint8
+}
+
+func (e *ReplyError) Error() string {
+	return "socks5: upstream proxy replied: " + prettyReply(e.Code)
+}
+
+// Unwrap makes the replies that refuse the connection match
+// dialer.ErrNotAllowed, and the ones reporting that the destination
+// cannot be reached match dialer.ErrUnreachable.
+func (e *ReplyError) Unwrap() error {
+	switch e.Code {
+	case socks5RespConnectionNotAllowed:
+		return dialer.ErrNotAllowed
+	case socks5RespNetworkUnreachable, socks5RespHostUnreachable, socks5RespConnectionRefused, socks5RespTTLExpired:
+		return dialer.ErrUnreachable
+	default:
+		return nil
+	}
+}
+
+func prettyReply(rep uint8) string {
+	switch rep {
+	case socks5RespSuccess:
+		return "succeeded"
+	case socks5RespGeneralServerFailure:
+		return "general SOCKS server failure"
+	case socks5RespConnectionNotAllowed:
+		return "connection not allowed by ruleset"
+	case socks5RespNetworkUnreachable:
+		return "network unreachable"
+	case socks5RespHostUnreachable:
+		return "host unreachable"
+	case socks5RespConnectionRefused:
+		return "connection refused"
+	case socks5RespTTLExpired:
+		return "TTL expired"
+	case socks5RespCommandNotSupported:
+		return "command not supported"
+	case socks5RespAddressTypeNotSupported:
+		return "address type not supported"
+	default:
+		return "unassigned reply code " + strconv.Itoa(int(rep))
+	}
+}
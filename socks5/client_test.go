@@ -0,0 +1,99 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package socks5_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/booster-proj/proxy/auth"
+	"github.com/booster-proj/proxy/socks5"
+)
+
+func TestClient(t *testing.T) {
+	upstream := socks5.New()
+	upstream.Authenticator = auth.Static{"user": "pass"}
+	addr := serve(t, upstream)
+	target := echo(t)
+
+	var tests = []struct {
+		password string
+		err      bool
+	}{
+		{password: "pass", err: false},
+		{password: "wrong", err: true},
+	}
+
+	for _, test := range tests {
+		c := socks5.NewClient(addr)
+		c.Username = "user"
+		c.Password = test.password
+
+		conn, err := c.DialContext(context.Background(), "tcp", target)
+		if err != nil {
+			if !test.err {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if test.err {
+			t.Fatal("expected authentication error")
+		}
+
+		ping(t, conn)
+		conn.Close()
+	}
+}
+
+func TestClientReplyError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+
+	c := socks5.NewClient(serve(t, socks5.New()))
+	_, err = c.DialContext(context.Background(), "tcp", closed)
+
+	rerr, ok := err.(*socks5.ReplyError)
+	if !ok {
+		t.Fatalf("expected a reply error, found %v", err)
+	}
+	if rerr.Code != 5 {
+		t.Fatalf("unexpected reply code. Wanted 5, found %d", rerr.Code)
+	}
+}
+
+func TestClientChain(t *testing.T) {
+	upstream := serve(t, socks5.New())
+
+	front := socks5.New()
+	front.DialWith(socks5.NewClient(upstream))
+
+	conn, _ := request(t, serve(t, front), 1, echo(t), 0)
+	ping(t, conn)
+}
@@ -31,17 +31,12 @@ import (
 )
 
 // connect dials a new connection with target, which must be a canonical
-// address with host and port.
+// address with host and port. If the dial fails, the client receives a
+// reply code that describes the error.
 func (s *Proxy) Connect(ctx context.Context, conn net.Conn, target string) (net.Conn, error) {
-	// cap is just an estimation
-	buf := make([]byte, 0, 6+len(target))
-	buf = append(buf, socks5Version)
-
 	tconn, err := s.DialContext(ctx, "tcp", target)
 	if err != nil {
-		// TODO(daniel): Respond with proper code
-		buf = append(buf, socks5RespHostUnreachable, socks5FieldReserved)
-		if _, err := conn.Write(buf); err != nil {
+		if err := writeReply(conn, replyCode(err), nil); err != nil {
 			return nil, errors.New("Connect: unable to write connect response: " + err.Error())
 		}
 
@@ -49,28 +44,14 @@ func (s *Proxy) Connect(ctx context.Context, conn net.Conn, target string) (net.
 	}
 	// BUG: sometimes there is no err BUT the connection is nil
 	if tconn == nil {
+		writeReply(conn, socks5RespGeneralServerFailure, nil)
 		return nil, errors.New("Connect: Dial returned nil connection")
 	}
 
-	buf = append(buf, socks5RespSuccess, socks5FieldReserved)
-
-	// bnd addr
-	addr := tconn.LocalAddr().(*net.TCPAddr)
-	ip := addr.IP
-	port := uint16(addr.Port)
-
-	if ip4 := ip.To4(); ip4 != nil {
-		buf = append(buf, socks5IP4)
-		ip = ip4
-	} else {
-		buf = append(buf, socks5IP6)
+	if err := writeReply(conn, socks5RespSuccess, tconn.LocalAddr()); err != nil {
+		tconn.Close()
+		return nil, errors.New("Connect: unable to write connect response: " + err.Error())
 	}
-	buf = append(buf, ip...)
-
-	// bdn port
-	buf = append(buf, byte(port>>8), byte(port)&0xff)
-
-	conn.Write(buf)
 
 	return tconn, nil
 }
@@ -0,0 +1,125 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package socks5_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/booster-proj/proxy/dialer"
+	"github.com/booster-proj/proxy/socks5"
+	"github.com/booster-proj/proxy/transmit"
+)
+
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+func TestConnectReplyCode(t *testing.T) {
+	// obtain the address of a closed port.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+
+	deny := dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, dialer.ErrNotAllowed
+	})
+
+	var tests = []struct {
+		dialer dialer.Dialer
+		target string
+		rep    byte
+	}{
+		{dialer: dialer.Default, target: closed, rep: 5},            // connection refused
+		{dialer: deny, target: "93.184.216.34:443", rep: 2},         // not allowed by ruleset
+		{dialer: dialer.Default, target: "host.invalid:80", rep: 4}, // host unreachable
+	}
+
+	for _, test := range tests {
+		s := socks5.New()
+		s.DialWith(test.dialer)
+
+		request(t, serve(t, s), 1, test.target, test.rep)
+	}
+}
+
+func TestHandleReplyCode(t *testing.T) {
+	addr := serve(t, socks5.New())
+
+	var tests = []struct {
+		in  []byte
+		rep byte
+	}{
+		{in: []byte{5, 1, 0, 5, 9, 0, 1, 127, 0, 0, 1, 0, 80}, rep: 7}, // command not supported
+		{in: []byte{5, 1, 0, 5, 1, 0, 7, 127, 0, 0, 1, 0, 80}, rep: 8}, // address type not supported
+	}
+
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if _, err := conn.Write(test.in); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		readReply(t, conn, test.rep)
+	}
+}
+
+func TestConnectSession(t *testing.T) {
+	sessions := make(chan transmit.Session, 1)
+	s := socks5.New()
+	s.OnSession = func(sess transmit.Session) { sessions <- sess }
+
+	target := echo(t)
+	conn, _ := request(t, serve(t, s), 1, target, 0)
+	ping(t, conn)
+	conn.Close()
+
+	sess := <-sessions
+	if sess.Protocol != "socks5" || sess.Target != target || sess.Source != conn.LocalAddr().String() {
+		t.Fatalf("unexpected session: %+v", sess)
+	}
+	if sess.BytesSent != 5 || sess.BytesReceived != 5 {
+		t.Fatalf("unexpected byte count: wanted (5, 5), found (%d, %d)", sess.BytesSent, sess.BytesReceived)
+	}
+	if sess.Reason != transmit.ReasonEOF {
+		t.Fatalf("unexpected reason: wanted %v, found %v", transmit.ReasonEOF, sess.Reason)
+	}
+}
@@ -30,15 +30,24 @@ import (
 	"net"
 )
 
+// Username/password sub-negotiation fields. See RFC 1929.
+const (
+	userPassVersion       = uint8(1)
+	userPassStatusSuccess = uint8(0)
+	userPassStatusFailure = uint8(1)
+)
+
 // negotiate performs the very first method subnegotiation when handling a new
-// connection.
-func (s *Proxy) Negotiate(conn net.Conn) error {
+// connection. If the receiver is configured with an Authenticator, clients
+// are required to authenticate using username and password, and the name
+// of the authenticated user is returned.
+func (s *Proxy) Negotiate(conn net.Conn) (string, error) {
 
 	// len is just an estimation
 	buf := make([]byte, 7)
 
 	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-		return errors.New("proxy: failed to read negotiation: " + err.Error())
+		return "", errors.New("proxy: failed to read negotiation: " + err.Error())
 	}
 
 	v := buf[0]         // protocol version
@@ -52,29 +61,92 @@ func (s *Proxy) Negotiate(conn net.Conn) error {
 
 	// Check version number
 	if v != socks5Version {
-		return errors.New("proxy: unsupported version: " + string(v))
+		return "", errors.New("proxy: unsupported version: " + string(v))
 	}
 
 	if _, err := io.ReadFull(conn, buf[:nm]); err != nil {
-		return errors.New("proxy: failed to read methods: " + err.Error())
+		return "", errors.New("proxy: failed to read methods: " + err.Error())
 	}
 
 	// select one method; could also be socksV5MethodNoAcceptableMethods
-	m := acceptMethod(buf)
+	m := acceptMethod(s.supportedMethods(), buf)
 
 	buf = buf[:0]
 	buf = append(buf, socks5Version)
 	buf = append(buf, m)
 
 	if _, err := conn.Write(buf); err != nil {
-		return errors.New("proxy: unable to write negotitation response: " + err.Error())
+		return "", errors.New("proxy: unable to write negotitation response: " + err.Error())
+	}
+
+	switch m {
+	case socks5MethodNoAcceptableMethods:
+		return "", errors.New("proxy: no acceptable authentication method")
+	case socks5MethodUsernamePassword:
+		return s.authenticate(conn)
+	default:
+		return "", nil
+	}
+}
+
+// authenticate performs the username/password sub-negotiation
+// described in RFC 1929.
+func (s *Proxy) authenticate(conn net.Conn) (string, error) {
+	buf := make([]byte, 255)
+
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", errors.New("proxy: failed to read authentication request: " + err.Error())
+	}
+
+	v := buf[0]       // sub-negotiation version
+	ul := int(buf[1]) // username length
+
+	if v != userPassVersion {
+		return "", errors.New("proxy: unsupported authentication version: " + string(v))
+	}
+
+	if _, err := io.ReadFull(conn, buf[:ul]); err != nil {
+		return "", errors.New("proxy: failed to read username: " + err.Error())
+	}
+	user := string(buf[:ul])
+
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return "", errors.New("proxy: failed to read password length: " + err.Error())
 	}
+	pl := int(buf[0]) // password length
 
-	return nil
+	if _, err := io.ReadFull(conn, buf[:pl]); err != nil {
+		return "", errors.New("proxy: failed to read password: " + err.Error())
+	}
+	password := string(buf[:pl])
+
+	authErr := s.Authenticator.Authenticate(user, password)
+
+	status := userPassStatusSuccess
+	if authErr != nil {
+		status = userPassStatusFailure
+	}
+	if _, err := conn.Write([]byte{userPassVersion, status}); err != nil {
+		return "", errors.New("proxy: unable to write authentication response: " + err.Error())
+	}
+	if authErr != nil {
+		return "", errors.New("proxy: authentication failed for user " + user + ": " + authErr.Error())
+	}
+
+	return user, nil
+}
+
+// supportedMethods returns the methods that the receiver is
+// willing to accept, in order of preference.
+func (s *Proxy) supportedMethods() []uint8 {
+	if s.Authenticator != nil {
+		return []uint8{socks5MethodUsernamePassword}
+	}
+	return []uint8{socks5MethodNoAuth}
 }
 
-func acceptMethod(m []uint8) uint8 {
-	for _, sm := range supportedMethods {
+func acceptMethod(supported, m []uint8) uint8 {
+	for _, sm := range supported {
 		for _, tm := range m {
 			if sm == tm {
 				return sm
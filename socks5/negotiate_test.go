@@ -25,14 +25,15 @@ SOFTWARE.
 package socks5_test
 
 import (
+	"bytes"
 	"testing"
 
+	"github.com/booster-proj/proxy/auth"
 	"github.com/booster-proj/proxy/socks5"
 )
 
 func TestNegotiate(t *testing.T) {
 	s5 := new(socks5.Proxy)
-	conn := new(conn)
 
 	var tests = []struct {
 		in  []byte
@@ -40,35 +41,84 @@ func TestNegotiate(t *testing.T) {
 		err bool // should expect negotiation error?
 	}{
 		{in: []byte{5, 2, 0, 1}, out: []byte{5, 0}, err: false}, // successful response
-		{in: []byte{5, 1, 1}, out: []byte{5, 0xff}, err: false}, // command not supported
+		{in: []byte{5, 1, 1}, out: []byte{5, 0xff}, err: true},  // command not supported
 		{in: []byte{4}, out: []byte{}, err: true},               // wrong version
-		{in: []byte{5, 0, 1}, out: []byte{}, err: true},         // wrong methods number
+		{in: []byte{5, 0, 1}, out: []byte{5, 0xff}, err: true},  // wrong methods number
 	}
 
 	for _, test := range tests {
+		conn := new(conn)
 		if _, err := conn.Write(test.in); err != nil {
 			t.Fatal(err)
 		}
 
-		if err := s5.Negotiate(conn); err != nil {
+		if _, err := s5.Negotiate(conn); err != nil {
 			// only fail if not expecting any error
 			if !test.err {
 				t.Fatal(err)
-			} else {
-				return
 			}
+		} else if test.err {
+			t.Fatalf("expected negotiation error with input %v", test.in)
 		}
 
-		buf := make([]byte, 2)
-		if _, err := conn.Read(buf); err != nil {
+		// input that was not consumed is left in the buffer,
+		// followed by the response.
+		if out := conn.Bytes(); !bytes.HasSuffix(out, test.out) {
+			t.Fatalf("unexpected result. Wanted %v, found %v", test.out, out)
+		}
+	}
+}
+
+func TestNegotiateUsernamePassword(t *testing.T) {
+	s5 := new(socks5.Proxy)
+	s5.Authenticator = auth.Static{"user": "pass"}
+
+	var tests = []struct {
+		in   []byte
+		out  []byte
+		user string
+		err  bool
+	}{
+		{in: []byte{5, 2, 0, 2, 1, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'},
+			out:  []byte{5, 2, 1, 0},
+			user: "user",
+			err:  false}, // successful authentication
+
+		{in: []byte{5, 2, 0, 2, 1, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 'x'},
+			out: []byte{5, 2, 1, 1},
+			err: true}, // wrong password
+
+		{in: []byte{5, 2, 0, 2, 5, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'},
+			out: []byte{5, 2},
+			err: true}, // wrong sub-negotiation version
+
+		{in: []byte{5, 1, 0},
+			out: []byte{5, 0xff},
+			err: true}, // client does not support authentication
+	}
+
+	for _, test := range tests {
+		conn := new(conn)
+		if _, err := conn.Write(test.in); err != nil {
 			t.Fatal(err)
 		}
 
-		for i, v := range buf {
-			if v != test.out[i] {
-				t.Fatalf("unexpected result. Wanted %v, found %v", test.out, buf)
+		user, err := s5.Negotiate(conn)
+		if err != nil {
+			if !test.err {
+				t.Fatal(err)
 			}
+		} else if test.err {
+			t.Fatalf("expected negotiation error with input %v", test.in)
 		}
 
+		if user != test.user {
+			t.Fatalf("unexpected user. Wanted %q, found %q", test.user, user)
+		}
+		// input that was not consumed is left in the buffer,
+		// followed by the response.
+		if out := conn.Bytes(); !bytes.HasSuffix(out, test.out) {
+			t.Fatalf("unexpected result. Wanted %v, found %v", test.out, out)
+		}
 	}
 }
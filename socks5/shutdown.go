@@ -0,0 +1,156 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// DefaultGracePeriod is the grace period used by proxies that do not
+// specify one.
+const DefaultGracePeriod = 30 * time.Second
+
+// ErrServerClosed is returned by Serve after a call to Shutdown.
+var ErrServerClosed = errors.New("socks5: Server closed")
+
+// Shutdown gracefully shuts down the proxy, without interrupting the active
+// connections: the listeners are closed first, then Shutdown waits for the
+// connections to terminate. If ctx expires before that, the remaining
+// connections are closed, and their number is returned together with the
+// context's error.
+//
+// Only the connections accepted by Serve are tracked. Once Shutdown has
+// been called, Serve returns ErrServerClosed.
+func (s *Proxy) Shutdown(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	s.closed = true
+	for ln := range s.listeners {
+		ln.Close()
+		delete(s.listeners, ln)
+	}
+	if s.drained == nil {
+		s.drained = make(chan struct{})
+		if len(s.conns) == 0 {
+			close(s.drained)
+		}
+	}
+	drained := s.drained
+	s.mu.Unlock()
+
+	select {
+	case <-drained:
+		return 0, nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.conns)
+	if n == 0 {
+		return 0, nil
+	}
+	for conn, cancel := range s.conns {
+		cancel()
+		conn.Close()
+	}
+	return n, ctx.Err()
+}
+
+func (s *Proxy) gracePeriod() time.Duration {
+	if s.GracePeriod == 0 {
+		return DefaultGracePeriod
+	}
+	return s.GracePeriod
+}
+
+func (s *Proxy) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// trackListener adds ln to the listeners closed by Shutdown. Returns false
+// if the proxy is already shutting down.
+func (s *Proxy) trackListener(ln net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[ln] = struct{}{}
+	return true
+}
+
+func (s *Proxy) untrackListener(ln net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ln.Close()
+	delete(s.listeners, ln)
+}
+
+// trackConn adds conn to the connections drained by Shutdown, returning
+// the context that should be used to handle it, which is canceled if the
+// connection is closed by Shutdown. Returns false if the proxy is already
+// shutting down.
+func (s *Proxy) trackConn(conn net.Conn) (context.Context, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]context.CancelFunc)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.conns[conn] = cancel
+	return ctx, true
+}
+
+func (s *Proxy) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cancel, ok := s.conns[conn]; ok {
+		cancel()
+		delete(s.conns, conn)
+	}
+	if s.drained != nil && len(s.conns) == 0 {
+		select {
+		case <-s.drained:
+		default:
+			close(s.drained)
+		}
+	}
+}
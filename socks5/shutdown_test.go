@@ -0,0 +1,136 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package socks5_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/booster-proj/proxy/socks5"
+)
+
+// listen starts s on a loopback listener, returning its address and
+// the channel that receives the error returned by Serve.
+func listen(ctx context.Context, t *testing.T, s *socks5.Proxy) (string, <-chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(ctx, ln) }()
+
+	return ln.Addr().String(), errc
+}
+
+func TestShutdown(t *testing.T) {
+	var tests = []struct {
+		// duration of the tunnel, after the shutdown started
+		keep    time.Duration
+		timeout time.Duration
+		cut     int
+		err     error
+	}{
+		{keep: 50 * time.Millisecond, timeout: time.Second, cut: 0, err: nil},
+		{keep: time.Second, timeout: 50 * time.Millisecond, cut: 1, err: context.DeadlineExceeded},
+	}
+
+	for i, test := range tests {
+		s := socks5.New()
+		addr, errc := listen(context.Background(), t, s)
+
+		conn, _ := request(t, addr, 1, echo(t), 0)
+		ping(t, conn)
+		time.AfterFunc(test.keep, func() { conn.Close() })
+
+		ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+		n, err := s.Shutdown(ctx)
+		cancel()
+		if n != test.cut || err != test.err {
+			t.Fatalf("%d: unexpected result: wanted (%d, %v), found (%d, %v)", i, test.cut, test.err, n, err)
+		}
+		if err := <-errc; err != socks5.ErrServerClosed {
+			t.Fatalf("%d: unexpected Serve error: wanted %v, found %v", i, socks5.ErrServerClosed, err)
+		}
+
+		// new connections are refused
+		if _, err := net.Dial("tcp", addr); err == nil {
+			t.Fatalf("%d: listener is still open after Shutdown", i)
+		}
+	}
+}
+
+func TestShutdownCut(t *testing.T) {
+	s := socks5.New()
+	addr, _ := listen(context.Background(), t, s)
+
+	conn, _ := request(t, addr, 1, echo(t), 0)
+	ping(t, conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if n, _ := s.Shutdown(ctx); n != 1 {
+		t.Fatalf("unexpected number of connections closed: wanted 1, found %d", n)
+	}
+
+	// the tunnel has to be closed by the proxy
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("tunnel is still open after Shutdown")
+	} else if err, ok := err.(net.Error); ok && err.Timeout() {
+		t.Fatal("tunnel is still open after Shutdown")
+	}
+}
+
+func TestServeGracePeriod(t *testing.T) {
+	s := socks5.New()
+	s.GracePeriod = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr, errc := listen(ctx, t, s)
+
+	conn, _ := request(t, addr, 1, echo(t), 0)
+	ping(t, conn)
+
+	start := time.Now()
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("unexpected error: wanted %v, found %v", context.Canceled, err)
+	}
+	if d := time.Since(start); d < s.GracePeriod {
+		t.Fatalf("Serve returned before the grace period: %v", d)
+	}
+
+	// the proxy cannot be restarted
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(context.Background(), ln); err != socks5.ErrServerClosed {
+		t.Fatalf("unexpected error: wanted %v, found %v", socks5.ErrServerClosed, err)
+	}
+}
@@ -33,8 +33,11 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/booster-proj/proxy/auth"
 	"github.com/booster-proj/proxy/dialer"
 	"github.com/booster-proj/proxy/transmit"
 	"upspin.io/log"
@@ -91,20 +94,73 @@ const (
 	socks5IP6 = uint8(4)
 )
 
-var (
-	supportedMethods = []uint8{socks5MethodNoAuth}
-)
+// DefaultIdleTimeout is the idle timeout of the tunnels opened by the clients, used
+// by the proxies returned by New.
+const DefaultIdleTimeout = 10 * time.Minute
+
+// DefaultDialTimeout is the default maximum duration the proxy waits for
+// the connection to the destination requested by a client.
+const DefaultDialTimeout = 10 * time.Second
 
 // Proxy represents a SOCKS5 proxy server implementation.
 type Proxy struct {
 	dialer.Dialer
 	port int
+
+	// Authenticator, if not nil, is used to validate the credentials
+	// of the clients, that are required to authenticate using the
+	// username/password method (RFC 1929).
+	Authenticator auth.Authenticator
+
+	// DialTimeout is the maximum duration the proxy waits for the
+	// connection to the destination requested by a client. If zero,
+	// DefaultDialTimeout is used.
+	DialTimeout time.Duration
+
+	// BindTimeout is the maximum duration the proxy waits for an
+	// inbound connection after a BIND request. If zero,
+	// DefaultBindTimeout is used.
+	BindTimeout time.Duration
+
+	// UDPIdleTimeout is the duration after which the connection to a
+	// destination of an UDP association is closed, if no datagrams are
+	// exchanged with it. If zero, DefaultUDPIdleTimeout is used.
+	UDPIdleTimeout time.Duration
+	// MaxUDPDestinations is the maximum number of destinations each
+	// UDP association can use at the same time. Datagrams to other
+	// destinations are dropped. If zero, DefaultMaxUDPDestinations is
+	// used.
+	MaxUDPDestinations int
+
+	// GracePeriod is the time given to the active connections to
+	// terminate when the context passed to Serve is canceled, after
+	// which they are closed. If zero, DefaultGracePeriod is used.
+	GracePeriod time.Duration
+
+	// OnSession, if not nil, is called each time a tunnel opened by
+	// a client is closed. It is called synchronously, before the
+	// client connection is closed.
+	OnSession func(transmit.Session)
+
+	// Relay copies the data of the tunnels opened by the clients.
+	// Its timeouts, buffers and throttling can be configured.
+	Relay transmit.Relay
+
+	mu        sync.Mutex
+	closed    bool // set by Shutdown
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]context.CancelFunc
+	drained   chan struct{} // closed when no conns are left after Shutdown
 }
 
 // New returns a new Proxy instance.
 func New() *Proxy {
 	return &Proxy{
 		Dialer: dialer.Default,
+		Relay: transmit.Relay{
+			IdleTimeout: DefaultIdleTimeout,
+			BufferSize:  int(transmit.DTU),
+		},
 	}
 }
 
@@ -115,29 +171,52 @@ func (s *Proxy) DialWith(d dialer.Dialer) {
 	}
 }
 
-// ListenAndServe accepts and handles TCP connections
-// using the SOCKS5 protocol.
-func (s *Proxy) ListenAndServe(ctx context.Context, port int) error {
-	p := strconv.Itoa(port)
-	ln, err := net.Listen("tcp", ":"+p)
+// ListenAndServe listens on the TCP network address addr and then calls
+// Serve to handle the incoming connections.
+func (s *Proxy) ListenAndServe(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
-	defer ln.Close()
+	return s.Serve(ctx, ln)
+}
 
-	errc := make(chan error)
-	defer close(errc)
+// Serve accepts the connections on ln, handling each of them using
+// the SOCKS5 protocol.
+// Serve closes ln when returning, which happens when ln fails, Shutdown
+// is called or ctx is canceled. In the latter case the active connections
+// are drained as Shutdown does, waiting at most for the grace period of
+// the receiver.
+func (s *Proxy) Serve(ctx context.Context, ln net.Listener) error {
+	if !s.trackListener(ln) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.untrackListener(ln)
 
+	errc := make(chan error, 1)
 	go func() {
 		for {
 			conn, err := ln.Accept()
 			if err != nil {
-				errc <- fmt.Errorf("ListenAndServe: cannot accept conn: %v", err)
+				if s.shuttingDown() {
+					errc <- ErrServerClosed
+					return
+				}
+				errc <- fmt.Errorf("Serve: cannot accept conn: %v", err)
 				return
 			}
 
+			// the connections outlive ctx, as they have to be
+			// drained when it is canceled.
+			hctx, ok := s.trackConn(conn)
+			if !ok {
+				conn.Close()
+				continue
+			}
 			go func() {
-				if err = s.Handle(ctx, conn); err != nil {
+				defer s.untrackConn(conn)
+				if err := s.Handle(hctx, conn); err != nil {
 					log.Error.Println(err)
 				}
 			}()
@@ -148,7 +227,11 @@ func (s *Proxy) ListenAndServe(ctx context.Context, port int) error {
 	case err := <-errc:
 		return err
 	case <-ctx.Done():
-		ln.Close()
+		sctx, cancel := context.WithTimeout(context.Background(), s.gracePeriod())
+		defer cancel()
+		if n, _ := s.Shutdown(sctx); n > 0 {
+			log.Info.Printf("Serve: %d connection(s) closed after the grace period", n)
+		}
 		<-errc // wait for listener to return
 		return ctx.Err()
 	}
@@ -169,9 +252,13 @@ func (s *Proxy) Handle(ctx context.Context, conn net.Conn) error {
 	defer conn.Close()
 
 	// method sub-negotiation phase
-	if err := s.Negotiate(conn); err != nil {
+	user, err := s.Negotiate(conn)
+	if err != nil {
 		return err
 	}
+	if user != "" {
+		ctx = auth.NewContext(ctx, user)
+	}
 
 	// request details
 
@@ -193,23 +280,38 @@ func (s *Proxy) Handle(ctx context.Context, conn net.Conn) error {
 
 	target, err := ReadAddress(conn)
 	if err != nil {
+		if _, ok := err.(AddrTypeError); ok {
+			writeReply(conn, socks5RespAddressTypeNotSupported, nil)
+		}
 		return err
 	}
 
 	log.Debug.Printf("Handle: performing [%v] to: %v", prettyCmd(cmd), target)
 
 	var tconn net.Conn
-	_ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	timeout := s.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	_ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	switch cmd {
 	case socks5CmdConnect:
 		tconn, err = s.Connect(_ctx, conn, target)
 	case socks5CmdAssociate:
-		tconn, err = s.Associate(_ctx, conn, target)
+		// the association lasts as long as the control
+		// connection, data is relayed by Associate itself.
+		if err = s.Associate(ctx, conn, target); err != nil {
+			return errors.New("Handle: unable to perform CMD(" + strconv.Itoa(int(cmd)) + "): " + err.Error())
+		}
+		return nil
 	case socks5CmdBind:
-		tconn, err = s.Bind(_ctx, conn, target)
+		// waiting for the inbound connection is not bound to the
+		// dial timeout.
+		tconn, err = s.Bind(ctx, conn, target)
 	default:
+		writeReply(conn, socks5RespCommandNotSupported, nil)
 		return errors.New("Handle: unexpected CMD(" + strconv.Itoa(int(cmd)) + ")")
 	}
 	if err != nil {
@@ -218,23 +320,99 @@ func (s *Proxy) Handle(ctx context.Context, conn net.Conn) error {
 	defer tconn.Close()
 
 	// start proxying
-	start := time.Now()
+	sess := transmit.Session{
+		Protocol: s.Protocol(),
+		Source:   conn.RemoteAddr().String(),
+		Target:   target,
+		Start:    time.Now(),
+	}
 	ptp := fmt.Sprintf("%v <-> %v (%v)", conn.LocalAddr(), tconn.RemoteAddr(), target)
+	if user, ok := auth.UserFromContext(ctx); ok {
+		ptp += " user(" + user + ")"
+		sess.User = user
+	}
 
 	log.Info.Printf("Open: %v", ptp)
-	defer func() {
-		end := time.Now()
-		d := end.Sub(start)
-		log.Info.Printf("Close: %v d(%v)", ptp, d)
-	}()
 
-	ctx = transmit.NewContext(ctx, time.Minute*10, 1500)
-	if err = transmit.Data(ctx, conn, tconn); err != nil {
+	sess.Stats, err = s.Relay.Data(ctx, conn, tconn)
+
+	log.Info.Printf("Close: %v d(%v) sent(%d) recv(%d) reason(%v)", ptp, sess.Duration, sess.BytesSent, sess.BytesReceived, sess.Reason)
+	if s.OnSession != nil {
+		s.OnSession(sess)
+	}
+
+	if err != nil {
 		return errors.New(ptp + ": " + err.Error())
 	}
 	return nil
 }
 
+// replyCode returns the REP field value that best describes err,
+// usually returned by a dialer.
+func replyCode(err error) uint8 {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var repErr *ReplyError
+
+	switch {
+	case err == nil:
+		return socks5RespSuccess
+	case errors.As(err, &repErr):
+		// propagate the reply of an upstream proxy
+		return repErr.Code
+	case errors.Is(err, dialer.ErrNotAllowed):
+		return socks5RespConnectionNotAllowed
+	case errors.Is(err, dialer.ErrUnreachable):
+		return socks5RespHostUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5RespConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5RespNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return socks5RespHostUnreachable
+	case errors.As(err, &dnsErr):
+		// the name could not be resolved
+		return socks5RespHostUnreachable
+	case errors.Is(err, context.DeadlineExceeded):
+		return socks5RespTTLExpired
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socks5RespTTLExpired
+	default:
+		return socks5RespGeneralServerFailure
+	}
+}
+
+// writeReply writes a SOCKS5 reply to w, using rep as REP field. addr
+// fills the BND.ADDR and BND.PORT fields, if nil the IPv4 zero address
+// is used instead.
+func writeReply(w io.Writer, rep uint8, addr net.Addr) error {
+	ip, port := net.IPv4zero, 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+
+	buf := make([]byte, 0, 6+net.IPv6len)
+	buf = append(buf, socks5Version, rep, socks5FieldReserved)
+
+	if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, socks5IP4)
+		buf = append(buf, ip4...)
+	} else {
+		buf = append(buf, socks5IP6)
+		buf = append(buf, ip.To16()...)
+	}
+	buf = append(buf, byte(port>>8), byte(port))
+
+	_, err := w.Write(buf)
+	return err
+}
+
 func prettyCmd(cmd uint8) string {
 	switch cmd {
 	case socks5CmdConnect:
@@ -295,7 +473,7 @@ func ReadHost(r io.Reader) (string, error) {
 		}
 		bytesToRead = int(buf[0])
 	default:
-		return "", errors.New("ReadHost: got unknown address type " + strconv.Itoa(int(atype)))
+		return "", AddrTypeError(atype)
 	}
 
 	if cap(buf) < bytesToRead {
@@ -317,6 +495,14 @@ func ReadHost(r io.Reader) (string, error) {
 	return host, nil
 }
 
+// AddrTypeError is returned when an address is encoded using
+// an unknown address type.
+type AddrTypeError uint8
+
+func (e AddrTypeError) Error() string {
+	return "ReadHost: got unknown address type " + strconv.Itoa(int(e))
+}
+
 // ReadPort deals with the port part of ReadAddress.
 func ReadPort(r io.Reader) (string, error) {
 	buf := make([]byte, 2)
@@ -387,7 +573,7 @@ func EncodePortBinary(port string) ([]byte, error) {
 	if err != nil {
 		return nil, errors.New("EncodePortBinary: failed to parse port number: " + port)
 	}
-	if p < 1 || p > 0xffff {
+	if p < 0 || p > 0xffff {
 		return nil, errors.New("EncodePortBinary: port number out of range: " + port)
 	}
 
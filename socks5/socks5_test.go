@@ -26,7 +26,10 @@ package socks5_test
 
 import (
 	"bytes"
+	"context"
+	"io"
 	"net"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -45,6 +48,110 @@ func (c *conn) SetDeadline(t time.Time) error      { return nil }
 func (c *conn) SetReadDeadline(t time.Time) error  { return nil }
 func (c *conn) SetWriteDeadline(t time.Time) error { return nil }
 
+// serve makes s handle the connections accepted on a loopback
+// listener, returning the address of the listener.
+func serve(t *testing.T, s *socks5.Proxy) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go s.Serve(ctx, ln)
+
+	return ln.Addr().String()
+}
+
+// echo starts a TCP server that writes back what it reads,
+// returning its address.
+func echo(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// ping writes a message to conn and checks that it is echoed back.
+func ping(t *testing.T, conn net.Conn) {
+	msg := []byte("hello")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatalf("unexpected data. Wanted %q, found %q", msg, buf)
+	}
+}
+
+// request dials addr, negotiates the no authentication method and sends
+// a request with command cmd and destination target, returning the
+// connection and the address contained in the reply, if the reply
+// code matches rep.
+func request(t *testing.T, addr string, cmd byte, target string, rep byte) (net.Conn, string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	tbuf, err := socks5.EncodeAddressBinary(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := []byte{5, 1, 0, 5, cmd, 0}
+	if _, err := conn.Write(append(buf, tbuf...)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != 5 || buf[1] != 0 {
+		t.Fatalf("unexpected negotiation response: %v", buf[:2])
+	}
+
+	return conn, readReply(t, conn, rep)
+}
+
+// readReply reads a reply from conn and checks that its reply code
+// matches rep. Returns the BND.ADDR and BND.PORT fields.
+func readReply(t *testing.T, r io.Reader, rep byte) string {
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != 5 || buf[1] != rep {
+		t.Fatalf("unexpected reply. Wanted REP(%d), found %v", rep, buf)
+	}
+
+	addr, err := socks5.ReadAddress(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
 func TestReadAddress(t *testing.T) {
 	conn := new(conn)
 
@@ -96,3 +203,34 @@ func TestReadAddress(t *testing.T) {
 		}
 	}
 }
+
+func TestServe(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socks5.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- socks5.New().Serve(ctx, ln) }()
+
+	c := socks5.NewClient(path)
+	c.Forward = dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial("unix", addr)
+	})
+	conn, err := c.DialContext(context.Background(), "tcp", echo(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping(t, conn)
+	conn.Close()
+
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("unexpected error: wanted %v, found %v", context.Canceled, err)
+	}
+	if _, err := net.Dial("unix", path); err == nil {
+		t.Fatal("listener is still open after Serve returned")
+	}
+}
@@ -0,0 +1,455 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transmit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrIdleTimeout is returned by Data when the connections are closed
+// because no data was transferred for the idle timeout.
+var ErrIdleTimeout = errors.New("transmit: idle timeout")
+
+// BufferPool is an interface for getting and returning temporary byte
+// slices used when copying data, see httputil.BufferPool.
+type BufferPool interface {
+	Get() []byte
+	Put([]byte)
+}
+
+// StatsSink receives the statistics of the tunnels closed by a Relay.
+type StatsSink interface {
+	Record(Stats)
+}
+
+// Relay copies data between pairs of connections. The zero value is
+// ready to be used. A Relay can be used concurrently, and must not be
+// modified while in use.
+type Relay struct {
+	// IdleTimeout is the maximum duration the tunnel stays open
+	// without data being transferred in either direction. If zero,
+	// DefaultIdleTimeout is used.
+	IdleTimeout time.Duration
+	// UpTimeout and DownTimeout, if not zero, are the maximum duration
+	// without data being transferred from src to dst and from dst to
+	// src, respectively. They do not apply to a direction whose sender
+	// already finished sending data.
+	UpTimeout   time.Duration
+	DownTimeout time.Duration
+
+	// BufferSize is the size of the buffers used to copy data. If zero,
+	// DTU is used.
+	BufferSize int
+	// BufferPool, if not nil, provides the buffers used to copy data,
+	// instead of allocating new ones for each tunnel.
+	BufferPool BufferPool
+
+	// Throttle, if not nil, limits the bandwidth of the tunnels.
+	Throttle *Throttle
+
+	// Stats, if not nil, receives the statistics of each tunnel when
+	// it is closed.
+	Stats StatsSink
+	// OnOpen, if not nil, is called before starting to copy data.
+	OnOpen func(src, dst net.Conn)
+	// OnClose, if not nil, is called when the tunnel is closed, with
+	// the values returned by Data.
+	OnClose func(src, dst net.Conn, stats Stats, err error)
+}
+
+func (r *Relay) idleTimeout() time.Duration {
+	if r.IdleTimeout == 0 {
+		return DefaultIdleTimeout
+	}
+	return r.IdleTimeout
+}
+
+func (r *Relay) getBuffer() []byte {
+	if r.BufferPool != nil {
+		return r.BufferPool.Get()
+	}
+	if r.BufferSize == 0 {
+		return make([]byte, DTU)
+	}
+	return make([]byte, r.BufferSize)
+}
+
+func (r *Relay) putBuffer(b []byte) {
+	if r.BufferPool != nil {
+		r.BufferPool.Put(b)
+	}
+}
+
+// Data copies data from src to dst and the other way around, until both
+// directions are done, returning the statistics of the transfer, which are
+// valid even if an error is returned. When one of the two peers stops
+// sending data, i.e. a read returns io.EOF, the write side of the other
+// connection is closed, if it supports it (see net.TCPConn.CloseWrite),
+// leaving the opposite direction open. Otherwise both connections are
+// closed.
+//
+// Closes the connections when one of the timeouts of the receiver expires,
+// returning ErrIdleTimeout, or when ctx is done, returning ctx.Err(). No go
+// routine started by Data outlives it.
+//
+// The client is identified by the address of src and the user stored in
+// ctx, if any, see auth.NewContext. If src and dst are TCP connections and
+// the tunnel is not throttled, data is moved by the kernel where possible.
+func (r *Relay) Data(ctx context.Context, src net.Conn, dst net.Conn) (Stats, error) {
+	t := newTunnel(ctx, r, src, dst)
+	defer t.release()
+
+	if r.OnOpen != nil {
+		r.OnOpen(src, dst)
+	}
+
+	done := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		select {
+		case <-ctx.Done():
+			t.teardown(ctx.Err())
+		case <-done:
+		}
+	}()
+
+	copied := make(chan struct{}, 2)
+	go func() {
+		t.copy(dst, src, &t.up)
+		copied <- struct{}{}
+	}()
+	go func() {
+		t.copy(src, dst, &t.down)
+		copied <- struct{}{}
+	}()
+	<-copied
+	<-copied
+
+	close(done)
+	<-watched
+	t.stop()
+
+	stats, err := t.stats(ctx)
+	if r.Stats != nil {
+		r.Stats.Record(stats)
+	}
+	if r.OnClose != nil {
+		r.OnClose(src, dst, stats, err)
+	}
+	return stats, err
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// direction stores the state of one of the two directions of a tunnel.
+type direction struct {
+	timeout time.Duration
+	lims    []*Limiter
+
+	// accessed atomically
+	n       int64 // bytes copied
+	last    int64 // unix nano of the last transfer
+	done    int32 // set when the sender finished sending data
+	waiting int32 // set while waiting for bandwidth
+}
+
+// throttled reports whether d is waiting for bandwidth, i.e. it is
+// transferring data, although slowly.
+func (d *direction) throttled() bool {
+	return atomic.LoadInt32(&d.waiting) == 1
+}
+
+func (d *direction) expired(now time.Time) (time.Duration, bool) {
+	if d.timeout == 0 || atomic.LoadInt32(&d.done) == 1 {
+		return 0, false
+	}
+	if d.throttled() {
+		return d.timeout, true
+	}
+	return d.timeout - now.Sub(time.Unix(0, atomic.LoadInt64(&d.last))), true
+}
+
+// tunnel stores the state shared by the two directions of a Data call.
+type tunnel struct {
+	relay    *Relay
+	src, dst net.Conn
+	idle     time.Duration
+	start    time.Time
+
+	up   direction // from src to dst
+	down direction // from dst to src
+
+	// accessed atomically
+	last      int64 // unix nano of the last transfer
+	firstByte int64 // nanoseconds before the first byte received
+
+	limits  *limits
+	release func()
+	// wctx is canceled when the tunnel is closed, interrupting the
+	// waits for bandwidth.
+	wctx   context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	timer  *time.Timer // checks the timeouts
+	closed bool
+	err    error // reason of the teardown
+}
+
+func newTunnel(ctx context.Context, r *Relay, src, dst net.Conn) *tunnel {
+	t := &tunnel{
+		relay: r,
+		src:   src,
+		dst:   dst,
+		idle:  r.idleTimeout(),
+		start: time.Now(),
+	}
+	t.up.timeout = r.UpTimeout
+	t.down.timeout = r.DownTimeout
+	t.touch(&t.up)
+	t.touch(&t.down)
+
+	t.release = func() {}
+	if r.Throttle != nil {
+		t.limits, t.release = r.Throttle.limits(ctx, src)
+		t.up.lims = t.limits.up
+		t.down.lims = t.limits.down
+	}
+	t.wctx, t.cancel = context.WithCancel(context.Background())
+
+	t.mu.Lock()
+	t.timer = time.AfterFunc(t.period(), t.checkIdle)
+	t.mu.Unlock()
+
+	return t
+}
+
+// period returns the shortest timeout of the tunnel.
+func (t *tunnel) period() time.Duration {
+	p := t.idle
+	for _, d := range []time.Duration{t.up.timeout, t.down.timeout} {
+		if d > 0 && d < p {
+			p = d
+		}
+	}
+	return p
+}
+
+func (t *tunnel) touch(d *direction) {
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&t.last, now)
+	atomic.StoreInt64(&d.last, now)
+}
+
+// account adds n bytes to d, updating the last activity.
+func (t *tunnel) account(d *direction, n int64) {
+	t.touch(d)
+	if atomic.AddInt64(&d.n, n) == n && d == &t.down {
+		atomic.StoreInt64(&t.firstByte, int64(time.Since(t.start)))
+	}
+}
+
+// checkIdle tears the tunnel down if one of its timeouts expired,
+// otherwise it schedules itself for the next expiration.
+func (t *tunnel) checkIdle() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return
+	}
+
+	now := time.Now()
+	next := t.idle - now.Sub(time.Unix(0, atomic.LoadInt64(&t.last)))
+	if t.up.throttled() || t.down.throttled() {
+		// waiting for bandwidth is not idling.
+		next = t.idle
+	}
+	for _, d := range []*direction{&t.up, &t.down} {
+		if left, ok := d.expired(now); ok && left < next {
+			next = left
+		}
+	}
+	if next <= 0 {
+		t.close(ErrIdleTimeout)
+		return
+	}
+	t.timer.Reset(next)
+}
+
+// teardown closes both connections, unblocking the pending reads and
+// writes. Only the first err is recorded.
+func (t *tunnel) teardown(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.closed {
+		t.close(err)
+	}
+}
+
+// close must be called with t.mu held.
+func (t *tunnel) close(err error) {
+	t.closed = true
+	t.err = err
+	t.timer.Stop()
+	t.cancel()
+	t.src.Close()
+	t.dst.Close()
+}
+
+// stop prevents any further teardown, leaving the connections open.
+func (t *tunnel) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	t.timer.Stop()
+	t.cancel()
+}
+
+// stats returns the statistics of the tunnel, together with the error
+// that caused its teardown, if any.
+func (t *tunnel) stats(ctx context.Context) (Stats, error) {
+	t.mu.Lock()
+	err := t.err
+	t.mu.Unlock()
+
+	stats := Stats{
+		BytesSent:     atomic.LoadInt64(&t.up.n),
+		BytesReceived: atomic.LoadInt64(&t.down.n),
+		FirstByte:     time.Duration(atomic.LoadInt64(&t.firstByte)),
+		Duration:      time.Since(t.start),
+	}
+	switch {
+	case err == nil || err == io.EOF:
+		return stats, nil
+	case err == ErrIdleTimeout:
+		stats.Reason = ReasonIdle
+	case err == ctx.Err():
+		stats.Reason = ReasonCanceled
+	default:
+		stats.Reason = ReasonError
+	}
+	return stats, err
+}
+
+// copy copies data from src to dst, until src returns io.EOF or an
+// error occurs, accounting it to d.
+func (t *tunnel) copy(dst, src net.Conn, d *direction) {
+	var err error
+	if tdst, tsrc, ok := spliceable(dst, src); ok && len(d.lims) == 0 {
+		// data moved by the kernel cannot be throttled
+		err = t.splice(tdst, tsrc, d)
+	} else {
+		err = t.loop(dst, src, d)
+	}
+
+	if err == io.EOF {
+		atomic.StoreInt32(&d.done, 1)
+		// propagate the half-close, the other direction
+		// might still have data to transfer.
+		if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+			return
+		}
+	}
+	t.teardown(err)
+}
+
+// loop copies data from src to dst through a buffer of the relay.
+// Returns io.EOF when src is exhausted.
+func (t *tunnel) loop(dst, src net.Conn, d *direction) error {
+	buf := t.relay.getBuffer()
+	defer t.relay.putBuffer(buf)
+
+	for {
+		n, err := src.Read(buf)
+		if n > 0 && len(d.lims) > 0 {
+			atomic.StoreInt32(&d.waiting, 1)
+			err := t.limits.wait(t.wctx, d.lims, n)
+			atomic.StoreInt32(&d.waiting, 0)
+			t.touch(d)
+			if err != nil {
+				return err
+			}
+		}
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+			t.account(d, int64(n))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// spliceChunk is the maximum amount of data moved by a single ReadFrom
+// call in splice.
+const spliceChunk = 1 << 20
+
+// splice copies data from src to dst using dst.ReadFrom, which lets the
+// kernel move the data without copying it to user space, where
+// supported. Returns io.EOF when src is exhausted.
+func (t *tunnel) splice(dst, src *net.TCPConn, d *direction) error {
+	defer src.SetReadDeadline(time.Time{})
+
+	// transfers are accounted only when ReadFrom returns: the chunk
+	// size and the deadline make it return often enough for the
+	// idle check to notice them.
+	period := t.period() / 2
+	lr := &io.LimitedReader{R: src}
+	for {
+		src.SetReadDeadline(time.Now().Add(period))
+		lr.N = spliceChunk
+		n, err := dst.ReadFrom(lr)
+		if n > 0 {
+			t.account(d, n)
+		}
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			// the idle check decides whether the tunnel
+			// has to be closed.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if lr.N > 0 {
+			// ReadFrom stopped before the limit, src is
+			// exhausted.
+			return io.EOF
+		}
+	}
+}
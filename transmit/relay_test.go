@@ -0,0 +1,148 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transmit_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/booster-proj/proxy/transmit"
+)
+
+type countingPool struct {
+	gets, puts int32
+}
+
+func (p *countingPool) Get() []byte {
+	atomic.AddInt32(&p.gets, 1)
+	return make([]byte, 512)
+}
+
+func (p *countingPool) Put(b []byte) {
+	atomic.AddInt32(&p.puts, 1)
+}
+
+type sink chan transmit.Stats
+
+func (s sink) Record(stats transmit.Stats) { s <- stats }
+
+func TestRelay(t *testing.T) {
+	pool := new(countingPool)
+	stats := make(sink, 1)
+	var opened, closed int32
+	r := &transmit.Relay{
+		BufferPool: pool,
+		Stats:      stats,
+		OnOpen:     func(src, dst net.Conn) { atomic.AddInt32(&opened, 1) },
+		OnClose: func(src, dst net.Conn, stats transmit.Stats, err error) {
+			atomic.AddInt32(&closed, 1)
+		},
+	}
+
+	// pipes disable the splice path
+	client, src := net.Pipe()
+	dst, server := net.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := r.Data(context.Background(), src, dst)
+		errc <- err
+	}()
+
+	go func() {
+		client.Write(make([]byte, 2048))
+		client.Close()
+	}()
+	if _, err := io.ReadFull(server, make([]byte, 2048)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	if s := <-stats; s.BytesSent != 2048 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+	if opened != 1 || closed != 1 {
+		t.Fatalf("unexpected hook calls: open %d, close %d", opened, closed)
+	}
+	if pool.gets != 2 || pool.puts != 2 {
+		t.Fatalf("unexpected pool usage: get %d, put %d", pool.gets, pool.puts)
+	}
+}
+
+func TestRelayDirectionTimeout(t *testing.T) {
+	var tests = []struct {
+		name     string
+		relay    *transmit.Relay
+		expected bool // the tunnel is closed by the timeout
+	}{
+		{name: "up", relay: &transmit.Relay{UpTimeout: 100 * time.Millisecond}, expected: true},
+		{name: "down", relay: &transmit.Relay{DownTimeout: 100 * time.Millisecond}, expected: false},
+	}
+
+	for _, test := range tests {
+		client, src := tcpPipe(t)
+		dst, server := tcpPipe(t)
+		errc := make(chan error, 1)
+		go func() {
+			_, err := test.relay.Data(context.Background(), src, dst)
+			errc <- err
+		}()
+
+		// only the server sends data
+		buf := make([]byte, 1)
+		deadline := time.Now().Add(300 * time.Millisecond)
+		for time.Now().Before(deadline) {
+			if _, err := server.Write(buf); err != nil {
+				break
+			}
+			if _, err := client.Read(buf); err != nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		select {
+		case err := <-errc:
+			if !test.expected {
+				t.Fatalf("%v: unexpected teardown: %v", test.name, err)
+			}
+			if err != transmit.ErrIdleTimeout {
+				t.Fatalf("%v: unexpected error: wanted %v, found %v", test.name, transmit.ErrIdleTimeout, err)
+			}
+		default:
+			if test.expected {
+				t.Fatalf("%v: tunnel was not closed", test.name)
+			}
+			client.Close()
+			server.Close()
+			<-errc
+		}
+	}
+}
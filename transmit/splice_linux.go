@@ -0,0 +1,64 @@
+//go:build linux
+// +build linux
+
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transmit
+
+import "net"
+
+// spliceable returns the TCP connections underlying dst and src, if data
+// can be moved between them with splice(2). Wrapped connections are
+// unwrapped, see unwrap.
+func spliceable(dst, src net.Conn) (*net.TCPConn, *net.TCPConn, bool) {
+	tdst, ok := unwrap(dst).(*net.TCPConn)
+	if !ok {
+		return nil, nil, false
+	}
+	tsrc, ok := unwrap(src).(*net.TCPConn)
+	if !ok {
+		return nil, nil, false
+	}
+	return tdst, tsrc, true
+}
+
+// unwrap returns the innermost connection wrapped by conn, following the
+// connections that expose it with an Unwrap method. Wrappers must not
+// alter the data read or written, only observe the connection, e.g. its
+// Close calls. Wrappers that cannot be bypassed yet, e.g. because they
+// still hold buffered data, return nil.
+func unwrap(conn net.Conn) net.Conn {
+	for {
+		w, ok := conn.(interface{ Unwrap() net.Conn })
+		if !ok {
+			return conn
+		}
+		inner := w.Unwrap()
+		if inner == nil {
+			return conn
+		}
+		conn = inner
+	}
+}
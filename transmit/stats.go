@@ -0,0 +1,93 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transmit
+
+import (
+	"time"
+)
+
+// Reason describes why a tunnel was closed.
+type Reason uint8
+
+// Possible Reason values.
+const (
+	// ReasonEOF means that both peers stopped sending data.
+	ReasonEOF Reason = iota
+	// ReasonIdle means that no data was transferred for the idle timeout.
+	ReasonIdle
+	// ReasonCanceled means that the context of the tunnel was done.
+	ReasonCanceled
+	// ReasonError means that reading from or writing to one of the
+	// connections failed.
+	ReasonError
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonEOF:
+		return "eof"
+	case ReasonIdle:
+		return "idle"
+	case ReasonCanceled:
+		return "canceled"
+	case ReasonError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Stats describes the data transferred through a tunnel, from the point
+// of view of its source connection.
+type Stats struct {
+	// BytesSent is the amount of data copied from src to dst.
+	BytesSent int64
+	// BytesReceived is the amount of data copied from dst to src.
+	BytesReceived int64
+	// FirstByte is the time elapsed before the first byte was
+	// received from dst. Zero if no data was received.
+	FirstByte time.Duration
+	// Duration is the lifetime of the tunnel.
+	Duration time.Duration
+	// Reason describes why the tunnel was closed.
+	Reason Reason
+}
+
+// Session is the record of a tunnel opened by a proxy on behalf of one
+// of its clients, emitted when the tunnel is closed.
+type Session struct {
+	// Protocol is the protocol spoken by the client, e.g. "socks5".
+	Protocol string
+	// User is the authenticated user, if any.
+	User string
+	// Source is the address of the client.
+	Source string
+	// Target is the destination requested by the client.
+	Target string
+	// Start is the time the tunnel was opened at.
+	Start time.Time
+
+	Stats
+}
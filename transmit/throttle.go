@@ -0,0 +1,293 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transmit
+
+import (
+	"context"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/booster-proj/proxy/auth"
+)
+
+// Clock tells the time, and waits for it to pass. Limiters use it to
+// compute their rates.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After waits for the duration to elapse and then sends the
+	// current time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SystemClock is the Clock backed by the time package.
+var SystemClock Clock = systemClock{}
+
+// Limiter is a token bucket that limits the data passing through it to a
+// rate of bytes per second, allowing bursts of at most one second worth
+// of data. A nil Limiter does not limit anything.
+type Limiter struct {
+	rate  float64
+	clock Clock
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a full Limiter that allows rate bytes per second. If
+// clock is nil, SystemClock is used.
+func NewLimiter(rate int64, clock Clock) *Limiter {
+	if clock == nil {
+		clock = SystemClock
+	}
+	return &Limiter{
+		rate:   float64(rate),
+		clock:  clock,
+		tokens: float64(rate),
+		last:   clock.Now(),
+	}
+}
+
+// Reserve takes n tokens from the bucket, returning how long the caller
+// has to wait before consuming them. Reservations larger than the bucket
+// are allowed: the caller has to wait for the debt to be repaid.
+func (l *Limiter) Reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	l.tokens = math.Min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Wait blocks until n tokens are available, or ctx is done.
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	return wait(ctx, l.clock, l.Reserve(n))
+}
+
+func wait(ctx context.Context, clock Clock, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-clock.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Rate is a pair of limits, in bytes per second. Zero means unlimited.
+type Rate struct {
+	Up   int64 // from the client to the target
+	Down int64 // from the target to the client
+}
+
+// Throttle limits the bandwidth consumed by the tunnels that use it, see
+// WithThrottle. The same Throttle can be shared by several proxies, and
+// Throttles can be chained to combine global and per listener limits.
+type Throttle struct {
+	// Rate is shared by all the tunnels.
+	Rate Rate
+	// PerIP is shared by the tunnels opened by the same client IP.
+	PerIP Rate
+	// PerUser is shared by the tunnels opened by the same
+	// authenticated user, see auth.UserFromContext.
+	PerUser Rate
+
+	// Parent, if not nil, limits the tunnels too.
+	Parent *Throttle
+	// Clock is used by the limiters of the Throttle. If nil,
+	// SystemClock is used.
+	Clock Clock
+
+	mu     sync.Mutex
+	shared *buckets
+	ips    map[string]*buckets
+	users  map[string]*buckets
+}
+
+// buckets stores the limiters of a rate. They are removed from the
+// Throttle when no tunnel is using them.
+type buckets struct {
+	up, down *Limiter
+	refs     int
+}
+
+func (t *Throttle) newBuckets(r Rate) *buckets {
+	b := new(buckets)
+	if r.Up > 0 {
+		b.up = NewLimiter(r.Up, t.Clock)
+	}
+	if r.Down > 0 {
+		b.down = NewLimiter(r.Down, t.Clock)
+	}
+	return b
+}
+
+// limits are the limiters that apply to a tunnel.
+type limits struct {
+	up, down []*Limiter
+	clock    Clock
+}
+
+// acquire returns the limits of a tunnel opened by ip on behalf of user,
+// which can be empty, and the function that has to be called once the
+// tunnel is closed.
+func (t *Throttle) acquire(ip, user string) (*limits, func()) {
+	l := &limits{clock: t.Clock}
+	if l.clock == nil {
+		l.clock = SystemClock
+	}
+
+	var release []func()
+	add := func(b *buckets, free func()) {
+		if b.up != nil {
+			l.up = append(l.up, b.up)
+		}
+		if b.down != nil {
+			l.down = append(l.down, b.down)
+		}
+		b.refs++
+		release = append(release, func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if b.refs--; b.refs == 0 && free != nil {
+				free()
+			}
+		})
+	}
+
+	t.mu.Lock()
+	if t.shared == nil {
+		t.shared = t.newBuckets(t.Rate)
+	}
+	add(t.shared, nil)
+	if t.PerIP != (Rate{}) && ip != "" {
+		if t.ips == nil {
+			t.ips = make(map[string]*buckets)
+		}
+		b, ok := t.ips[ip]
+		if !ok {
+			b = t.newBuckets(t.PerIP)
+			t.ips[ip] = b
+		}
+		add(b, func() { delete(t.ips, ip) })
+	}
+	if t.PerUser != (Rate{}) && user != "" {
+		if t.users == nil {
+			t.users = make(map[string]*buckets)
+		}
+		b, ok := t.users[user]
+		if !ok {
+			b = t.newBuckets(t.PerUser)
+			t.users[user] = b
+		}
+		add(b, func() { delete(t.users, user) })
+	}
+	t.mu.Unlock()
+
+	if t.Parent != nil {
+		pl, prelease := t.Parent.acquire(ip, user)
+		l.up = append(l.up, pl.up...)
+		l.down = append(l.down, pl.down...)
+		release = append(release, prelease)
+	}
+
+	return l, func() {
+		for _, f := range release {
+			f()
+		}
+	}
+}
+
+// wait blocks until n bytes can pass through all the limiters in lims,
+// or ctx is done.
+func (l *limits) wait(ctx context.Context, lims []*Limiter, n int) error {
+	if len(lims) == 0 {
+		return nil
+	}
+	var d time.Duration
+	for _, lim := range lims {
+		if r := lim.Reserve(n); r > d {
+			d = r
+		}
+	}
+	return wait(ctx, l.clock, d)
+}
+
+// WithThrottle returns a context that makes Data limit the bandwidth of
+// the tunnel using t. The client is identified by the source connection
+// and the user stored in the context, if any.
+func WithThrottle(ctx context.Context, t *Throttle) context.Context {
+	return context.WithValue(ctx, throttleKey, t)
+}
+
+// ThrottleFromContext extracts the throttle from the context.
+func ThrottleFromContext(ctx context.Context) (*Throttle, bool) {
+	t, ok := ctx.Value(throttleKey).(*Throttle)
+	return t, ok && t != nil
+}
+
+// clientIP returns the IP address of the client connected to conn,
+// if available.
+func clientIP(conn net.Conn) string {
+	if conn.RemoteAddr() == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// limits returns the limits applying to a tunnel from src, together
+// with the function that releases them.
+func (t *Throttle) limits(ctx context.Context, src net.Conn) (*limits, func()) {
+	user, _ := auth.UserFromContext(ctx)
+	return t.acquire(clientIP(src), user)
+}
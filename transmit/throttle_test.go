@@ -0,0 +1,244 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transmit_test
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/booster-proj/proxy/auth"
+	"github.com/booster-proj/proxy/transmit"
+)
+
+// fakeClock is a Clock whose time passes only when waiting for it.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func (c *fakeClock) elapsed() time.Duration {
+	return c.Now().Sub(time.Unix(0, 0))
+}
+
+func TestLimiter(t *testing.T) {
+	clock := newFakeClock()
+	l := transmit.NewLimiter(1000, clock)
+
+	var tests = []struct {
+		advance time.Duration
+		n       int
+		wait    time.Duration
+	}{
+		{n: 1000, wait: 0},                                      // the bucket starts full
+		{n: 500, wait: 500 * time.Millisecond},                  // debt
+		{advance: time.Second, n: 500, wait: 0},                 // repaid
+		{advance: 10 * time.Second, n: 2000, wait: time.Second}, // bursts are limited
+		{advance: 500 * time.Millisecond, n: 100, wait: 600 * time.Millisecond},
+	}
+
+	for i, test := range tests {
+		clock.After(test.advance)
+		if wait := l.Reserve(test.n); wait != test.wait {
+			t.Fatalf("%d: unexpected wait: wanted %v, found %v", i, test.wait, wait)
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	const size = 50000
+
+	var tests = []struct {
+		name     string
+		throttle func(transmit.Clock) *transmit.Throttle
+		user     string
+		// elapsed time while sending size bytes upstream
+		elapsed time.Duration
+	}{
+		{
+			name: "global",
+			throttle: func(c transmit.Clock) *transmit.Throttle {
+				return &transmit.Throttle{Rate: transmit.Rate{Up: 10000}, Clock: c}
+			},
+			elapsed: 4 * time.Second,
+		},
+		{
+			name: "download only",
+			throttle: func(c transmit.Clock) *transmit.Throttle {
+				return &transmit.Throttle{Rate: transmit.Rate{Down: 10000}, Clock: c}
+			},
+			elapsed: 0,
+		},
+		{
+			name: "per ip",
+			throttle: func(c transmit.Clock) *transmit.Throttle {
+				return &transmit.Throttle{PerIP: transmit.Rate{Up: 25000}, Clock: c}
+			},
+			elapsed: time.Second,
+		},
+		{
+			name: "per user",
+			throttle: func(c transmit.Clock) *transmit.Throttle {
+				return &transmit.Throttle{PerUser: transmit.Rate{Up: 10000}, Clock: c}
+			},
+			user:    "user",
+			elapsed: 4 * time.Second,
+		},
+		{
+			name: "anonymous",
+			throttle: func(c transmit.Clock) *transmit.Throttle {
+				return &transmit.Throttle{PerUser: transmit.Rate{Up: 10000}, Clock: c}
+			},
+			elapsed: 0,
+		},
+		{
+			name: "parent",
+			throttle: func(c transmit.Clock) *transmit.Throttle {
+				parent := &transmit.Throttle{Rate: transmit.Rate{Up: 5000}, Clock: c}
+				return &transmit.Throttle{Rate: transmit.Rate{Up: 10000}, Parent: parent, Clock: c}
+			},
+			elapsed: 9 * time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		clock := newFakeClock()
+		ctx := transmit.WithThrottle(context.Background(), test.throttle(clock))
+		if test.user != "" {
+			ctx = auth.NewContext(ctx, test.user)
+		}
+
+		client, src := tcpPipe(t)
+		dst, server := tcpPipe(t)
+		errc := make(chan error, 1)
+		go func() { errc <- transmit.Data(ctx, src, dst) }()
+
+		go func() {
+			client.Write(make([]byte, size))
+			client.Close()
+		}()
+		if _, err := io.ReadFull(server, make([]byte, size)); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		server.Close()
+		if err := <-errc; err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		// allow for the rounding of the limiters
+		if d := clock.elapsed() - test.elapsed; d < -time.Millisecond || d > time.Millisecond {
+			t.Fatalf("%v: unexpected elapsed time: wanted %v, found %v", test.name, test.elapsed, clock.elapsed())
+		}
+	}
+}
+
+// gatedClock is a fakeClock whose waits complete only after open is
+// called, however long they are.
+type gatedClock struct {
+	*fakeClock
+	once sync.Once
+	gate chan struct{}
+}
+
+func newGatedClock() *gatedClock {
+	return &gatedClock{fakeClock: newFakeClock(), gate: make(chan struct{})}
+}
+
+func (c *gatedClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	go func() {
+		<-c.gate
+		ch <- <-c.fakeClock.After(d)
+	}()
+	return ch
+}
+
+func (c *gatedClock) open() {
+	c.once.Do(func() { close(c.gate) })
+}
+
+func TestThrottleIdleTimeout(t *testing.T) {
+	clock := newGatedClock()
+	defer clock.open()
+
+	r := &transmit.Relay{
+		IdleTimeout: 100 * time.Millisecond,
+		Throttle:    &transmit.Throttle{Rate: transmit.Rate{Up: 1000}, Clock: clock},
+	}
+
+	client, src := tcpPipe(t)
+	dst, server := tcpPipe(t)
+	defer client.Close()
+	defer server.Close()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := r.Data(context.Background(), src, dst)
+		errc <- err
+	}()
+
+	// the data exceeds the burst, the tunnel waits for bandwidth
+	// longer than the idle timeout.
+	const size = 5000
+	go client.Write(make([]byte, size))
+	time.Sleep(300 * time.Millisecond)
+
+	select {
+	case err := <-errc:
+		t.Fatalf("throttled tunnel closed as idle: %v", err)
+	default:
+	}
+
+	clock.open()
+	if _, err := io.ReadFull(server, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	server.Close()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -28,11 +28,8 @@ package transmit
 
 import (
 	"context"
-	"io"
 	"net"
 	"time"
-
-	"golang.org/x/sync/errgroup"
 )
 
 type key int
@@ -40,6 +37,7 @@ type key int
 const (
 	idleTimeoutKey key = iota
 	transmittingUnitKey
+	throttleKey
 )
 
 // DefaultIdleTimeout is the default duration of 5 minutes used
@@ -69,70 +67,33 @@ func TUFromContext(ctx context.Context) (int64, bool) {
 	return i, ok
 }
 
-// Data copies data from src to dst and the other way around.
-// Closes the connections when no data is transferred for a defined duration, i.e.
-// the idleTimeout value stored in the context or the DefaultIdleTimeout, if the
-// former is not present.
+// Data copies data from src to dst and the other way around, using a
+// Relay configured with the values stored in ctx: the idleTimeout (see
+// NewContext), or DefaultIdleTimeout if not present, the transmitting
+// unit, and the Throttle (see WithThrottle). See Relay.Data for details.
 func Data(ctx context.Context, src net.Conn, dst net.Conn) error {
-	g, ctx := errgroup.WithContext(ctx)
-
-	g.Go(func() error {
-		return proxyData(ctx, src, dst)
-	})
-	g.Go(func() error {
-		return proxyData(ctx, dst, src)
-	})
+	_, err := DataStats(ctx, src, dst)
+	return err
+}
 
-	if err := g.Wait(); err != nil && err != io.EOF {
-		return err
-	}
-	return nil
+// DataStats behaves like Data, also returning the statistics of the
+// transfer, which are valid even if an error is returned.
+func DataStats(ctx context.Context, src net.Conn, dst net.Conn) (Stats, error) {
+	return relayFromContext(ctx).Data(ctx, src, dst)
 }
 
-func proxyData(ctx context.Context, src net.Conn, dst net.Conn) error {
-	// allowed idle timeout before closing the connection.
-	idle := DefaultIdleTimeout
+// relayFromContext returns the Relay described by the values stored
+// in ctx.
+func relayFromContext(ctx context.Context) *Relay {
+	r := new(Relay)
 	if d, ok := DurationFromContext(ctx); ok {
-		idle = d
+		r.IdleTimeout = d
 	}
-
-	// transimitting unit
-	tu := DTU
 	if i, ok := TUFromContext(ctx); ok {
-		tu = i
-	}
-
-	done := func() {
-		src.Close()
-		dst.Close()
+		r.BufferSize = int(i)
 	}
-	timer := time.AfterFunc(idle, done)
-
-	errc := make(chan error, 1)
-	go func() {
-		for {
-			_, err := io.CopyN(src, dst, tu)
-			errc <- err
-		}
-		close(errc)
-	}()
-
-	for {
-		select {
-		case <-ctx.Done():
-			done()
-			timer.Stop()
-
-			return ctx.Err()
-		case err := <-errc:
-			if err != nil {
-				return err
-			}
-
-			// io operations did not return any errors. Reset
-			// deadline and keep on transferring data
-			timer.Reset(idle)
-		}
-
+	if t, ok := ThrottleFromContext(ctx); ok {
+		r.Throttle = t
 	}
+	return r
 }
@@ -0,0 +1,353 @@
+/*
+MIT License
+
+Copyright (c) 2018 KIM KeepInMind Gmbh/srl
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transmit_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/booster-proj/proxy/transmit"
+)
+
+// tcpPipe returns the two ends of a loopback TCP connection.
+func tcpPipe(t testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+
+	return c1, c2
+}
+
+// checkLeaks fails the test if the number of running go routines does
+// not go back to n in a reasonable time.
+func checkLeaks(t *testing.T, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("go routines leaked: wanted %d, found %d\n%s", n, runtime.NumGoroutine(), buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// tunnel connects a client and a server through Data, which runs in
+// its own go routine. Returns the client and server ends, and the
+// channel that receives the error returned by Data.
+func tunnel(ctx context.Context, t *testing.T) (net.Conn, net.Conn, <-chan error) {
+	client, src := tcpPipe(t)
+	dst, server := tcpPipe(t)
+
+	errc := make(chan error, 1)
+	go func() { errc <- transmit.Data(ctx, src, dst) }()
+
+	return client, server, errc
+}
+
+func TestDataHalfClose(t *testing.T) {
+	n := runtime.NumGoroutine()
+
+	client, server, errc := tunnel(context.Background(), t)
+
+	if _, err := io.WriteString(client, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	client.(*net.TCPConn).CloseWrite()
+
+	// the server receives EOF, while still being able to reply
+	b, err := ioutil.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ping" {
+		t.Fatalf("unexpected data: wanted %q, found %q", "ping", b)
+	}
+	if _, err := io.WriteString(server, "pong"); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	b, err = ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "pong" {
+		t.Fatalf("unexpected data: wanted %q, found %q", "pong", b)
+	}
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	checkLeaks(t, n)
+}
+
+func TestDataClose(t *testing.T) {
+	n := runtime.NumGoroutine()
+
+	// pipes do not support half-close, hence the whole
+	// tunnel is closed at the first EOF.
+	client, src := net.Pipe()
+	dst, server := net.Pipe()
+
+	errc := make(chan error, 1)
+	go func() { errc <- transmit.Data(context.Background(), src, dst) }()
+
+	client.Close()
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("unexpected error: wanted %v, found %v", io.EOF, err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	checkLeaks(t, n)
+}
+
+func TestDataTeardown(t *testing.T) {
+	var tests = []struct {
+		name   string
+		idle   time.Duration
+		cancel time.Duration // zero means never
+		err    error
+	}{
+		{name: "idle", idle: 50 * time.Millisecond, err: transmit.ErrIdleTimeout},
+		{name: "cancel", idle: time.Minute, cancel: 50 * time.Millisecond, err: context.Canceled},
+	}
+
+	for _, test := range tests {
+		n := runtime.NumGoroutine()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if test.cancel > 0 {
+			time.AfterFunc(test.cancel, cancel)
+		}
+		ctx = transmit.NewContext(ctx, test.idle, transmit.DTU)
+		client, server, errc := tunnel(ctx, t)
+
+		select {
+		case err := <-errc:
+			if err != test.err {
+				t.Fatalf("%v: unexpected error: wanted %v, found %v", test.name, test.err, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%v: tunnel was not closed", test.name)
+		}
+
+		// both peers see the tunnel closed
+		for _, conn := range []net.Conn{client, server} {
+			if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+				t.Fatalf("%v: unexpected error: wanted %v, found %v", test.name, io.EOF, err)
+			}
+			conn.Close()
+		}
+		cancel()
+		checkLeaks(t, n)
+	}
+}
+
+func TestDataActivity(t *testing.T) {
+	idle := 100 * time.Millisecond
+	ctx := transmit.NewContext(context.Background(), idle, transmit.DTU)
+	client, server, errc := tunnel(ctx, t)
+
+	// traffic in either direction keeps the tunnel open
+	buf := make([]byte, 1)
+	for i := 0; i < 10; i++ {
+		w, r := client, server
+		if i%2 == 1 {
+			w, r = server, client
+		}
+		if _, err := w.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		time.Sleep(idle / 2)
+	}
+
+	select {
+	case err := <-errc:
+		t.Fatalf("tunnel closed while active: %v", err)
+	default:
+	}
+}
+
+// opaqueConn hides the concrete type of the connection it embeds,
+// disabling the splice path of Data.
+type opaqueConn struct {
+	net.Conn
+}
+
+func TestDataLarge(t *testing.T) {
+	data := make([]byte, 5<<20)
+	rand.Read(data)
+
+	var tests = []struct {
+		name string
+		wrap func(net.Conn) net.Conn
+	}{
+		{name: "splice", wrap: func(c net.Conn) net.Conn { return c }},
+		{name: "loop", wrap: func(c net.Conn) net.Conn { return opaqueConn{c} }},
+	}
+
+	for _, test := range tests {
+		client, src := tcpPipe(t)
+		dst, server := tcpPipe(t)
+		errc := make(chan error, 1)
+		go func() { errc <- transmit.Data(context.Background(), test.wrap(src), test.wrap(dst)) }()
+
+		go func() {
+			client.Write(data)
+			client.Close()
+		}()
+		b, err := ioutil.ReadAll(server)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Fatalf("%v: data corrupted, read %d bytes out of %d", test.name, len(b), len(data))
+		}
+		server.Close()
+		if err := <-errc; err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+	}
+}
+
+func BenchmarkData(b *testing.B) {
+	const size = 32 << 10
+	var benchmarks = []struct {
+		name string
+		wrap func(net.Conn) net.Conn
+	}{
+		{name: "splice", wrap: func(c net.Conn) net.Conn { return c }},
+		{name: "loop", wrap: func(c net.Conn) net.Conn { return opaqueConn{c} }},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			client, src := tcpPipe(b)
+			dst, server := tcpPipe(b)
+			go transmit.Data(context.Background(), bm.wrap(src), bm.wrap(dst))
+
+			go func() {
+				buf := make([]byte, size)
+				for i := 0; i < b.N; i++ {
+					client.Write(buf)
+				}
+			}()
+
+			buf := make([]byte, size)
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := io.ReadFull(server, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDataStats(t *testing.T) {
+	var tests = []struct {
+		name   string
+		idle   time.Duration
+		close  bool // the peers close their connections
+		reason transmit.Reason
+	}{
+		{name: "eof", idle: time.Minute, close: true, reason: transmit.ReasonEOF},
+		{name: "idle", idle: 100 * time.Millisecond, reason: transmit.ReasonIdle},
+	}
+
+	for _, test := range tests {
+		client, src := tcpPipe(t)
+		dst, server := tcpPipe(t)
+
+		type result struct {
+			stats transmit.Stats
+			err   error
+		}
+		c := make(chan result, 1)
+		go func() {
+			ctx := transmit.NewContext(context.Background(), test.idle, transmit.DTU)
+			stats, err := transmit.DataStats(ctx, src, dst)
+			c <- result{stats, err}
+		}()
+
+		if _, err := io.WriteString(client, "ping"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(server, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if _, err := io.WriteString(server, "pong pong"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(client, make([]byte, 9)); err != nil {
+			t.Fatal(err)
+		}
+		if test.close {
+			client.Close()
+			server.Close()
+		}
+
+		res := <-c
+		if res.stats.BytesSent != 4 || res.stats.BytesReceived != 9 {
+			t.Fatalf("%v: unexpected byte count: wanted (4, 9), found (%d, %d)", test.name, res.stats.BytesSent, res.stats.BytesReceived)
+		}
+		if res.stats.FirstByte < 10*time.Millisecond || res.stats.FirstByte > res.stats.Duration {
+			t.Fatalf("%v: unexpected first byte time: %v, duration %v", test.name, res.stats.FirstByte, res.stats.Duration)
+		}
+		if res.stats.Reason != test.reason {
+			t.Fatalf("%v: unexpected reason: wanted %v, found %v (%v)", test.name, test.reason, res.stats.Reason, res.err)
+		}
+	}
+}